@@ -5,16 +5,72 @@ import (
 	"log"
 	"bufio"
 	"io"
+	"strconv"
 	"strings"
 )
 
 func (f *FS) TextCommand(cmd string) (string, error) {
-	switch strings.ToUpper(cmd) {
+	args := strings.Fields(cmd)
+	if len(args) == 0 {
+		args = []string{"HELP"}
+	}
+
+	switch strings.ToUpper(args[0]) {
 	case "PING":
 		return "PONG", nil
+	case "PIN", "UNPIN":
+		if len(args) != 2 {
+			return "usage: " + strings.ToUpper(args[0]) + " PATH", nil
+		}
+		inode, err := f.ResolvePath(args[1])
+		if err != nil {
+			return "", err
+		}
+		err = f.SetPin(inode, strings.ToUpper(args[0]) == "PIN")
+		if err != nil {
+			return "", err
+		}
+		return "OK", nil
+	case "PINS":
+		paths, err := f.PinnedPaths()
+		if err != nil {
+			return "", err
+		}
+		return strings.Join(append(paths, "OK"), "\n"), nil
+	case "PATH":
+		if len(args) != 2 {
+			return "usage: PATH INODE", nil
+		}
+		inode, err := strconv.ParseUint(args[1], 10, 64)
+		if err != nil {
+			return "", err
+		}
+		return f.PathOf(inode)
+	case "MV", "MVNX", "SWAP":
+		if len(args) != 3 {
+			return "usage: " + strings.ToUpper(args[0]) + " PATH NEWPATH", nil
+		}
+		flags := uint32(0)
+		switch strings.ToUpper(args[0]) {
+		case "MVNX":
+			flags = rename_noreplace
+		case "SWAP":
+			flags = rename_exchange
+		}
+		err := f.RenamePath(args[1], args[2], flags)
+		if err != nil {
+			return "", err
+		}
+		return "OK", nil
+	case "GC":
+		stats, err := f.GC()
+		if err != nil {
+			return "", err
+		}
+		return "freed " + stats.String(), nil
 	}
 
-	return "commands: HELP PING", nil
+	return "commands: HELP PING PIN UNPIN PINS PATH MV MVNX SWAP GC", nil
 }
 
 func (f *FS) SpawnAdminConsole() error {
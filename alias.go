@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/boltdb/bolt"
+)
+
+/* ALIASES
+
+see CONFLICT RESOLUTION in tx.go.
+
+when replay would put a remote object under a name we already use, it
+goes under an alias instead: "name-<dbid>", dbid being the database whose
+transaction collided.  alias entries live in the directory's "kids"
+bucket like any other entry, so Lookup and ReadDir present them as is.
+the index remembers what they are really called:
+
+"aliases": dir inode -> { alias name -> dbid (u16) + original name }
+
+the log always carries original names, and replay finds objects by oid
+before falling back to names, so aliases never leave this database.
+when an original name frees up here, an alias for it takes it back.
+*/
+
+func alias_index(tx *bolt.Tx) (*bolt.Bucket, error) {
+	b := tx.Bucket([]byte("aliases"))
+	if b == nil {
+		return nil, errors.New("Missing aliases bucket")
+	}
+	return b, nil
+}
+
+// the original name of an alias entry in dir, nil if name is not an alias
+func (f *FS) AliasOrig(tx *bolt.Tx, dir uint64, name []byte) ([]byte, error) {
+	ab, err := alias_index(tx)
+	if err != nil {
+		return nil, err
+	}
+	da := ab.Bucket(uint64_b(dir))
+	if da == nil {
+		return nil, nil
+	}
+	v := da.Get(name)
+	if len(v) < 2 {
+		return nil, nil
+	}
+	return append([]byte{}, v[2:]...), nil
+}
+
+// the name to log for entry name in dir
+func (f *FS) LogName(tx *bolt.Tx, dir uint64, name []byte) ([]byte, error) {
+	orig, err := f.AliasOrig(tx, dir, name)
+	if err != nil {
+		return nil, err
+	}
+	if orig == nil {
+		orig, err = f.ZombieOrig(tx, dir, name)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if orig == nil {
+		return name, nil
+	}
+	return orig, nil
+}
+
+// file a remote object under an alias for orig, returns the alias
+func (f *FS) addAlias(tx *bolt.Tx, dir uint64, dkids *bolt.Bucket, dbid uint16, orig []byte, val []byte) ([]byte, error) {
+	ab, err := alias_index(tx)
+	if err != nil {
+		return nil, err
+	}
+	da, err := ab.CreateBucketIfNotExists(uint64_b(dir))
+	if err != nil {
+		return nil, err
+	}
+
+	base := orig
+	suffix := fmt.Sprintf("-%d", dbid)
+	var name []byte
+	for n := 1; ; n++ {
+		if n > 1 {
+			suffix = fmt.Sprintf("-%d-%d", dbid, n)
+		}
+		if len(base) + len(suffix) > max_name_len {
+			base = base[:max_name_len - len(suffix)]
+		}
+		name = append(append([]byte{}, base...), suffix...)
+		if dkids.Get(name) == nil {
+			break
+		}
+	}
+
+	err = kid_put(tx, dkids, dir, name, val)
+	if err != nil {
+		return nil, err
+	}
+	return name, da.Put(name, append(uint16_b(dbid), orig...))
+}
+
+// entry name in dir was removed, renamed away or replaced: forget it as
+// an alias or zombie, and let an alias waiting for that name have it
+func (f *FS) unlinkedName(tx *bolt.Tx, dir uint64, dkids *bolt.Bucket, name []byte) error {
+	err := f.dropZombie(tx, dir, name)
+	if err != nil {
+		return err
+	}
+	ab, err := alias_index(tx)
+	if err != nil {
+		return err
+	}
+	da := ab.Bucket(uint64_b(dir))
+	if da == nil {
+		return nil
+	}
+	err = da.Delete(name)
+	if err != nil {
+		return err
+	}
+
+	if dkids.Get(name) != nil {
+		return nil
+	}
+
+	var alias []byte
+	c := da.Cursor()
+	for k, v := c.First(); k != nil; k, v = c.Next() {
+		if len(v) >= 2 && bytes.Equal(v[2:], name) {
+			alias = append([]byte{}, k...)
+			break
+		}
+	}
+	if alias == nil {
+		return nil
+	}
+
+	val := dkids.Get(alias)
+	if val != nil {
+		err = kid_put(tx, dkids, dir, name, val)
+		if err != nil {
+			return err
+		}
+		err = kid_delete(tx, dkids, dir, alias)
+		if err != nil {
+			return err
+		}
+	}
+	return da.Delete(alias)
+}
+
+// the entry in dir that a transaction from dbid means by name: found by
+// the object it acts on when it says, otherwise the alias for that dbid
+// before the plain name.  nil if we have no such entry.
+func (f *FS) replayEntry(tx *bolt.Tx, dbid uint16, dir uint64, dkids *bolt.Bucket, name []byte, obj uint64) ([]byte, error) {
+	ab, err := alias_index(tx)
+	if err != nil {
+		return nil, err
+	}
+	da := ab.Bucket(uint64_b(dir))
+
+	if obj != 0 {
+		local, err := f.replayInode(tx, dbid, obj)
+		if err != nil || local == 0 {
+			return nil, err
+		}
+		if v := dkids.Get(name); v != nil && b_uint64(v) == local {
+			return name, nil
+		}
+		if da == nil {
+			return nil, nil
+		}
+		c := da.Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			if len(v) >= 2 && bytes.Equal(v[2:], name) && b_uint64(dkids.Get(k)) == local {
+				return append([]byte{}, k...), nil
+			}
+		}
+		return nil, nil
+	}
+
+	if da != nil {
+		c := da.Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			if len(v) >= 2 && b_uint16(v[:2]) == dbid && bytes.Equal(v[2:], name) {
+				return append([]byte{}, k...), nil
+			}
+		}
+	}
+	if dkids.Get(name) != nil {
+		return name, nil
+	}
+	return nil, nil
+}
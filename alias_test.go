@@ -0,0 +1,87 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// a and b both make name before hearing of each other
+func aliasSetup(t *testing.T, names ...string) (*FS, *FS, Dir, Dir) {
+	a := testFS(t, 1)
+	b := testFS(t, 2)
+	ra, rb := Dir{inode: root_inode, fs: a}, Dir{inode: root_inode, fs: b}
+	for _, name := range names {
+		testMkdir(t, ra, name)
+		testMkdir(t, rb, name)
+	}
+	testSync(t, a, b)
+	return a, b, ra, rb
+}
+
+func TestAliasCollision(t *testing.T) {
+	a, b, ra, rb := aliasSetup(t, "n")
+	checkNames(t, "a", ra, "n", "n-2")
+	checkNames(t, "b", rb, "n", "n-1")
+
+	// the alias is the other database's object
+	if got := testOid(t, a, testLookupDir(t, ra, "n-2").inode); oid_dbid(got) != 2 {
+		t.Errorf("a's n-2 is oid %x", got)
+	}
+	if got := testOid(t, b, testLookupDir(t, rb, "n-1").inode); oid_dbid(got) != 1 {
+		t.Errorf("b's n-1 is oid %x", got)
+	}
+}
+
+// renaming an alias renames the original elsewhere, and frees its name
+func TestAliasRename(t *testing.T) {
+	a, b, ra, rb := aliasSetup(t, "n")
+	if err := testRename(ra, "n-2", ra, "m"); err != nil {
+		t.Fatal(err)
+	}
+	checkNames(t, "a", ra, "m", "n")
+	testSync(t, a, b)
+
+	// b's own n went to m, so a's takes the name back
+	checkNames(t, "b", rb, "m", "n")
+	for _, name := range []string{"m", "n"} {
+		oa := testOid(t, a, testLookupDir(t, ra, name).inode)
+		ob := testOid(t, b, testLookupDir(t, rb, name).inode)
+		if oa != ob {
+			t.Errorf("%s is %x on a, %x on b", name, oa, ob)
+		}
+	}
+}
+
+// removing the entry an alias stands in for promotes the alias
+func TestAliasPromote(t *testing.T) {
+	a, b, ra, rb := aliasSetup(t, "p")
+	own := testOid(t, b, testLookupDir(t, rb, "p").inode)
+	testRmdir(t, ra, "p")
+	checkNames(t, "a", ra, "p")
+	if got := testOid(t, a, testLookupDir(t, ra, "p").inode); got != own {
+		t.Errorf("a's p is %x, want b's %x", got, own)
+	}
+
+	testSync(t, a, b)
+	checkNames(t, "b", rb, "p")
+	if got := testOid(t, b, testLookupDir(t, rb, "p").inode); got != own {
+		t.Errorf("b's p is %x, want its own %x", got, own)
+	}
+}
+
+func TestAliasLongName(t *testing.T) {
+	long := strings.Repeat("l", max_name_len)
+	_, _, ra, _ := aliasSetup(t, long)
+	names := testNames(t, ra)
+	if len(names) != 2 {
+		t.Fatalf("a shows %d names", len(names))
+	}
+	for _, name := range names {
+		if len(name) > max_name_len {
+			t.Errorf("%d byte name", len(name))
+		}
+		if name != long && !strings.HasSuffix(name, "-2") {
+			t.Errorf("alias %q", name)
+		}
+	}
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"bazil.org/fuse"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"github.com/boltdb/bolt"
+	"os"
+	"syscall"
+	"time"
+)
+
+/* ATTRIBUTES
+
+InodeAttr, part of the inode record, see INODES in inode.go, little
+endian: Mode Uid Gid (u32) Atime Mtime Ctime (i64, unix nanoseconds).
+	Mode is an os.FileMode holding the permission, setuid, setgid and
+	sticky bits.  inodes from before attributes got default_attr.
+
+chmod, chown and utimes go through Setattr and are logged as TX_SETATTR.
+truncating changes content, so it is sealed and logged as TX_SETCONTENT
+like any other write; if a writer has unsealed writes, its staging copy
+is truncated instead and goes out with them.
+
+new inodes get the creator's uid and gid and the mode asked for, logged
+as a TX_SETATTR right after the creation.  content changes move mtime.
+ctime is local: when we changed the inode, or when a replayed change was
+made.
+*/
+
+// the mode bits chmod can set
+const attr_mode_mask = os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky
+
+type InodeAttr struct {
+	Mode uint32
+	Uid uint32
+	Gid uint32
+	Atime int64
+	Mtime int64
+	Ctime int64
+}
+
+const inode_attr_len = 3*4 + 3*8
+
+func (a *InodeAttr) Bytes() []byte {
+	buf := bytes.Buffer{}
+	binary.Write(&buf, binary.LittleEndian, a)
+	return buf.Bytes()
+}
+
+func InodeAttrFromBytes(b []byte) (*InodeAttr, error) {
+	if len(b) != inode_attr_len {
+		return nil, errors.New("Bad inode attribute record length")
+	}
+	a := InodeAttr{}
+	err := binary.Read(bytes.NewReader(b), binary.LittleEndian, &a)
+	if err != nil {
+		return nil, err
+	}
+	return &a, nil
+}
+
+// attributes of an inode from before them.  times stay 0, which Attr
+// leaves alone.
+func default_attr(typ byte) InodeAttr {
+	a := InodeAttr{Mode: 0644, Uid: uint32(os.Getuid()), Gid: uint32(os.Getgid())}
+	switch typ {
+	case inode_dir:
+		a.Mode = 0755
+	case inode_symlink:
+		a.Mode = 0777
+	}
+	return a
+}
+
+func load_attr(tx *bolt.Tx, inode uint64) (*InodeAttr, error) {
+	r, err := load_inode(tx, inode)
+	if err != nil {
+		return nil, err
+	}
+	if r == nil {
+		return nil, errors.New("Inode record missing")
+	}
+	return &r.Attr, nil
+}
+
+func save_attr(tx *bolt.Tx, inode uint64, a *InodeAttr) error {
+	r, err := load_inode(tx, inode)
+	if err != nil {
+		return err
+	}
+	if r == nil {
+		return errors.New("Inode record missing")
+	}
+	r.Attr = *a
+	return save_inode(tx, inode, r)
+}
+
+// apply the fields of a TX_SETATTR
+func (a *InodeAttr) apply(t *TxAttr) {
+	if t.Valid & tx_attr_mode != 0 {
+		a.Mode = t.Mode
+	}
+	if t.Valid & tx_attr_uid != 0 {
+		a.Uid = t.Uid
+	}
+	if t.Valid & tx_attr_gid != 0 {
+		a.Gid = t.Gid
+	}
+	if t.Valid & tx_attr_atime != 0 {
+		a.Atime = t.Atime
+	}
+	if t.Valid & tx_attr_mtime != 0 {
+		a.Mtime = t.Mtime
+	}
+}
+
+// copy into what Attr returns, keeping the file type bits
+func (a *InodeAttr) fill(attr *fuse.Attr) {
+	attr.Mode = attr.Mode & os.ModeType | os.FileMode(a.Mode) & attr_mode_mask
+	attr.Uid = a.Uid
+	attr.Gid = a.Gid
+	if a.Atime != 0 {
+		attr.Atime = time.Unix(0, a.Atime)
+	}
+	if a.Mtime != 0 {
+		attr.Mtime = time.Unix(0, a.Mtime)
+	}
+	if a.Ctime != 0 {
+		attr.Ctime = time.Unix(0, a.Ctime)
+	}
+}
+
+func (f *FS) LoadAttr(inode uint64) (*InodeAttr, error) {
+	var a *InodeAttr
+	err := f.db.View(func(tx *bolt.Tx) error {
+		var err error
+		a, err = load_attr(tx, inode)
+		return err
+	})
+	return a, err
+}
+
+// the record of a new inode, inside the transaction creating it
+func (f *FS) initInode(tx *bolt.Tx, inode uint64, typ byte, mode os.FileMode, h fuse.Header) error {
+	now := time.Now().UnixNano()
+	a := InodeAttr{
+		Mode: uint32(mode & attr_mode_mask),
+		Uid: h.Uid,
+		Gid: h.Gid,
+		Atime: now,
+		Mtime: now,
+		Ctime: now,
+	}
+	err := save_inode(tx, inode, new_inode_record(typ, a))
+	if err != nil {
+		return err
+	}
+	return f.logAttr(tx, inode, &a)
+}
+
+// log all of a as set
+func (f *FS) logAttr(tx *bolt.Tx, inode uint64, a *InodeAttr) error {
+	t := TxAttr{
+		Valid: tx_attr_mode | tx_attr_uid | tx_attr_gid | tx_attr_atime | tx_attr_mtime,
+		Mode: a.Mode,
+		Uid: a.Uid,
+		Gid: a.Gid,
+		Atime: a.Atime,
+		Mtime: a.Mtime,
+	}
+	_, err := f.NewTx(tx, TX_SETATTR, inode, t.Bytes(), 0, nil, inode)
+	return err
+}
+
+// chmod, chown, utimes and truncate of any inode
+func (f *FS) Setattr(inode uint64, req *fuse.SetattrRequest) error {
+	t := TxAttr{}
+	if req.Valid.Mode() {
+		t.Valid |= tx_attr_mode
+		t.Mode = uint32(req.Mode & attr_mode_mask)
+	}
+	if req.Valid.Uid() {
+		t.Valid |= tx_attr_uid
+		t.Uid = req.Uid
+	}
+	if req.Valid.Gid() {
+		t.Valid |= tx_attr_gid
+		t.Gid = req.Gid
+	}
+	if req.Valid.Atime() {
+		t.Valid |= tx_attr_atime
+		t.Atime = req.Atime.UnixNano()
+	}
+	if req.Valid.Mtime() {
+		t.Valid |= tx_attr_mtime
+		t.Mtime = req.Mtime.UnixNano()
+	}
+
+	// the truncated content is stored first and saved along with the
+	// attributes, so the change is all or nothing
+	var ref []byte
+	if req.Valid.Size() {
+		var h *Handle
+		if req.Valid.Handle() {
+			h = f.namedWriter(inode, req.Handle)
+		}
+		var err error
+		if h != nil {
+			// only its copy changes, until it seals
+			err = h.truncate(req.Size)
+		} else {
+			ref, err = f.truncatedContent(inode, req.Size)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if t.Valid == 0 && ref == nil {
+		return nil
+	}
+
+	err := f.db.Update(func(tx *bolt.Tx) error {
+		if ref != nil {
+			file := File{inode: inode, fs: f}
+			err := file.saveContent(tx, ref, req.Size)
+			if err != nil {
+				return err
+			}
+		}
+		if t.Valid == 0 {
+			return nil
+		}
+		a, err := load_attr(tx, inode)
+		if err != nil {
+			return err
+		}
+		a.apply(&t)
+		a.Ctime = time.Now().UnixNano()
+		err = save_attr(tx, inode, a)
+		if err != nil {
+			return err
+		}
+		orphan, err := f.IsOrphan(tx, inode)
+		if err != nil || orphan {
+			return err
+		}
+		_, err = f.NewTx(tx, TX_SETATTR, inode, t.Bytes(), 0, nil, inode)
+		return err
+	})
+	if err != nil || ref == nil {
+		return err
+	}
+
+	// writers with unsealed writes still win when they seal
+	for _, h := range f.writersOf(inode) {
+		h.mu.Lock()
+		if !h.dirty {
+			h.stale = true
+		}
+		h.mu.Unlock()
+	}
+	return nil
+}
+
+// inode's content cut off or padded with zeros to size, stored for
+// Setattr to save.  see BLOBS for writers that have it open.
+func (f *FS) truncatedContent(inode uint64, size uint64) ([]byte, error) {
+	switch f.InodeType(inode) {
+	case inode_file:
+	case inode_dir:
+		return nil, fuse.Errno(syscall.EISDIR)
+	default:
+		return nil, fuse.Errno(syscall.EINVAL)
+	}
+
+	fh, err := f.newStaging(inode, size == 0)
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(fh.Name())
+	err = fh.Truncate(int64(size))
+	if err == nil {
+		err = fh.Sync()
+	}
+	if cerr := fh.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return nil, err
+	}
+	ref, _, err := f.StoreChunkedFile(fh.Name())
+	return ref, err
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"os"
+	"syscall"
+	"testing"
+
+	"bazil.org/fuse"
+)
+
+// a truncate with other attributes changes all of them or none
+func TestSetattrTruncate(t *testing.T) {
+	f := testFS(t, 1)
+	root := Dir{inode: root_inode, fs: f}
+	file := testCreate(t, root, "f", "hello world")
+	before := len(testTxSince(t, f, map[uint16]uint64{}, repl_batch))
+	req := fuse.SetattrRequest{Valid: fuse.SetattrSize | fuse.SetattrMode, Size: 5, Mode: 0600}
+	if err := file.Setattr(&req, &fuse.SetattrResponse{}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if got := testContent(t, file); got != "hello" {
+		t.Errorf("content %q", got)
+	}
+	if at := file.Attr(); at.Mode & os.ModePerm != 0600 || at.Size != 5 {
+		t.Errorf("mode %v, size %d", at.Mode, at.Size)
+	}
+	list := testTxSince(t, f, map[uint16]uint64{}, repl_batch)[before:]
+	if len(list) != 2 || list[0].Op != TX_SETCONTENT || list[1].Op != TX_SETATTR {
+		t.Errorf("logged %d transactions", len(list))
+	}
+
+	d := testMkdir(t, root, "d")
+	err := d.Setattr(&req, &fuse.SetattrResponse{}, nil)
+	if err != fuse.Errno(syscall.EISDIR) {
+		t.Errorf("truncating a directory: %v", err)
+	}
+	if at := d.Attr(); at.Mode & os.ModePerm != 0755 {
+		t.Errorf("failed truncate changed the mode to %v", at.Mode)
+	}
+}
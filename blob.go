@@ -0,0 +1,319 @@
+package main
+
+import (
+	"bazil.org/fuse"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"github.com/boltdb/bolt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/* BLOBS
+
+file contents are immutable blobs named by their sha256:
+
+	storagepath/blobs/<hex sha256>
+
+a file's inode record has the content reference of its current content,
+see INODES in inode.go and CHUNKS in chunk.go.
+
+every handle open for writing gets a private staging copy of the content
+at storagepath/files/<inode>.<random>, and nobody else sees its writes.
+flushing or releasing it seals the staging copy into chunks, and commits
+them as the file's new content in one bolt transaction.  readers keep
+the content they opened until they reopen.  when two handles write the
+same file, the last one sealed wins.  a truncate through a handle cuts
+its own copy.  any other truncate is sealed right away, and writers that
+haven't written yet reload their copy from it.  identical chunks share one blob,
+and a peer can ask for a blob by hash alone.  blobs a peer holds may be
+evicted again, see CACHE in cache.go.
+*/
+
+var empty_hash = sha256.New().Sum(nil)
+
+const hash_len = sha256.Size
+
+func (f *FS) blobDir() string {
+	return f.storagepath + "/blobs"
+}
+
+func (f *FS) BlobPath(hash []byte) string {
+	return f.blobDir() + "/" + hex.EncodeToString(hash)
+}
+
+func (f *FS) stagingDir() string {
+	return f.storagepath + "/files"
+}
+
+// the hash a blob file name stands for
+func hex_hash(name string) ([]byte, error) {
+	hash, err := hex.DecodeString(name)
+	if err == nil && len(hash) != hash_len {
+		err = errors.New("Not a blob name")
+	}
+	return hash, err
+}
+
+func (f *FS) HasBlob(hash []byte) bool {
+	return exists(f.BlobPath(hash))
+}
+
+// make sure the blob store exists, and holds the empty blob
+func (f *FS) initBlobs() error {
+	err := os.MkdirAll(f.blobDir(), 0700)
+	if err != nil {
+		return err
+	}
+	if f.HasBlob(empty_hash) {
+		return nil
+	}
+	_, _, err = f.StoreBlob(bytes.NewReader(nil))
+	return err
+}
+
+// copy r into the blob store, returns its hash and size.  we wrote it,
+// so we keep it, see CACHE in cache.go.
+func (f *FS) StoreBlob(r io.Reader) ([]byte, uint64, error) {
+	return f.storeBlob(r, true)
+}
+
+// store a blob, taking custody of it if it's ours
+func (f *FS) storeBlob(r io.Reader, ours bool) ([]byte, uint64, error) {
+	tmp, err := ioutil.TempFile(f.blobDir(), ".tmp-")
+	if err != nil {
+		return nil, 0, err
+	}
+	defer os.Remove(tmp.Name()) // harmless once renamed
+
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(tmp, h), r)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+
+	hash := h.Sum(nil)
+	if ours {
+		// before looking, so the evictor can't take a cached copy
+		// from under us
+		err = f.takeCustody(hash)
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+	if f.HasBlob(hash) {
+		// about to be referenced again, keep gc off it
+		now := time.Now()
+		os.Chtimes(f.BlobPath(hash), now, now)
+		return hash, uint64(n), nil
+	}
+	err = os.Chmod(tmp.Name(), 0400)
+	if err != nil {
+		return nil, 0, err
+	}
+	err = os.Rename(tmp.Name(), f.BlobPath(hash))
+	if err != nil {
+		return nil, 0, err
+	}
+	return hash, uint64(n), nil
+}
+
+func (f *FS) StoreBlobFile(path string) ([]byte, uint64, error) {
+	fh, err := os.Open(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer fh.Close()
+	return f.StoreBlob(fh)
+}
+
+// whether inode is a regular file we know
+func (f *FS) IsFile(inode uint64) bool {
+	return f.InodeType(inode) == inode_file
+}
+
+// current content reference of inode, inside a bolt transaction
+func content_ref(tx *bolt.Tx, inode uint64) ([]byte, error) {
+	r, err := load_inode(tx, inode)
+	if err != nil {
+		return nil, err
+	}
+	if r == nil || len(r.Content) == 0 {
+		return empty_ref, nil
+	}
+	return r.Content, nil
+}
+
+func (f *FS) ContentRef(inode uint64) ([]byte, error) {
+	var ref []byte
+	err := f.db.View(func(tx *bolt.Tx) error {
+		var err error
+		ref, err = content_ref(tx, inode)
+		return err
+	})
+	return ref, err
+}
+
+// a private staging copy of inode for a writer, holding its current
+// content unless the writer truncates anyway
+func (f *FS) newStaging(inode uint64, trunc bool) (*os.File, error) {
+	fh, err := ioutil.TempFile(f.stagingDir(), strconv.FormatUint(inode, 10) + ".")
+	if err != nil {
+		return nil, err
+	}
+	if !trunc {
+		ref, err := f.ContentRef(inode)
+		if err == nil {
+			err = f.CopyContent(ref, fh)
+		}
+		if err == nil {
+			// Handle.Read reads on from the file offset
+			_, err = fh.Seek(0, 0)
+		}
+		if err != nil {
+			fh.Close()
+			os.Remove(fh.Name())
+			return nil, err
+		}
+	}
+	return fh, nil
+}
+
+// inode has unsealed writes at path, Attr should look there
+func (f *FS) setStaged(inode uint64, path string) {
+	f.openmu.Lock()
+	defer f.openmu.Unlock()
+	f.staged[inode] = path
+}
+
+func (f *FS) dropStaged(inode uint64, path string) {
+	f.openmu.Lock()
+	defer f.openmu.Unlock()
+	if f.staged[inode] == path {
+		delete(f.staged, inode)
+	}
+}
+
+func (f *FS) addWriter(h *Handle) {
+	f.openmu.Lock()
+	defer f.openmu.Unlock()
+	f.writers[h.file.inode] = append(f.writers[h.file.inode], h)
+}
+
+func (f *FS) dropWriter(h *Handle) {
+	f.openmu.Lock()
+	defer f.openmu.Unlock()
+	l := f.writers[h.file.inode]
+	for i := range l {
+		if l[i] == h {
+			l = append(l[:i:i], l[i+1:]...)
+			break
+		}
+	}
+	if len(l) == 0 {
+		delete(f.writers, h.file.inode)
+	} else {
+		f.writers[h.file.inode] = l
+	}
+}
+
+// handles open for writing inode
+func (f *FS) writersOf(inode uint64) []*Handle {
+	f.openmu.Lock()
+	defer f.openmu.Unlock()
+	return append([]*Handle{}, f.writers[inode]...)
+}
+
+// the writer of inode the kernel calls id.  writers are only named once
+// they write, the others still hold the sealed content.
+func (f *FS) namedWriter(inode uint64, id fuse.HandleID) *Handle {
+	for _, h := range f.writersOf(inode) {
+		h.mu.Lock()
+		named := h.named && h.kid == id
+		h.mu.Unlock()
+		if named {
+			return h
+		}
+	}
+	return nil
+}
+
+// what to stat for inode's times and blocks, and whether it is a staging
+// copy.  sealed content stats as its manifest, so only its times count.
+func (f *FS) statPath(inode uint64) (string, bool, error) {
+	f.openmu.Lock()
+	path := f.staged[inode]
+	f.openmu.Unlock()
+
+	if path != "" {
+		return path, true, nil
+	}
+	ref, err := f.ContentRef(inode)
+	if err != nil {
+		return "", false, err
+	}
+	_, hash, err := content_ref_split(ref)
+	if err != nil {
+		return "", false, err
+	}
+	return f.BlobPath(hash), false, nil
+}
+
+// seal whatever is in the staging copy at path as inode's content
+func (f *FS) SealStaging(inode uint64, path string) error {
+	ref, size, err := f.StoreChunkedFile(path)
+	if err != nil {
+		return err
+	}
+	file := File{inode: inode, fs: f}
+	return file.SaveContent(ref, size)
+}
+
+// staging copies left over from a crash, or working copies from before
+// them, have no writers anymore.  seal them, oldest first so the last
+// write wins as it would have, and remove them.
+func (f *FS) SealStagingFiles() error {
+	dir := f.stagingDir()
+	list, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	sort.Sort(by_mtime(list))
+	for _, fi := range list {
+		name := strings.SplitN(fi.Name(), ".", 2)[0]
+		inode, err := strconv.ParseUint(name, 10, 64)
+		if err != nil || fi.IsDir() {
+			continue
+		}
+		if f.IsFile(inode) {
+			err = f.SealStaging(inode, dir + "/" + fi.Name())
+			if err != nil {
+				return err
+			}
+		}
+		err = os.Remove(dir + "/" + fi.Name())
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type by_mtime []os.FileInfo
+
+func (l by_mtime) Len() int { return len(l) }
+func (l by_mtime) Swap(i, j int) { l[i], l[j] = l[j], l[i] }
+func (l by_mtime) Less(i, j int) bool { return l[i].ModTime().Before(l[j].ModTime()) }
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"errors"
+	"github.com/boltdb/bolt"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"time"
+)
+
+/* CACHE
+
+with a cache cap (-cache-mb) the blob store drops the least recently
+used blobs that some peer is sure to hold, until it fits again.  pinned
+content stays, see PINS in pin.go.
+
+a blob always has at least one custodian, a node that will keep it no
+matter what.  whoever stores a blob first, by writing the file, is its
+custodian, and so is anyone writing it again while holding only a cached
+copy.  a peer without a cache cap asks for custody when it fetches,
+and once it says it stored the blob the custodian we were becomes just
+another cache of it.  a blob we fetched without taking custody is always
+somewhere else.  only blobs we are not custodian of get evicted, so data
+nobody else has stored never goes.
+
+"blobcache": sha256 -> flags (byte) + last access (u64, unix seconds)
+	blobs without an entry are ours to keep: written here, or from
+	before the cache.
+
+accesses are counted in memory and written out when the evictor runs.
+*/
+
+const blob_custody byte = 1
+
+const cache_evict_every = time.Minute
+
+func blobcache_index(tx *bolt.Tx) (*bolt.Bucket, error) {
+	b := tx.Bucket([]byte("blobcache"))
+	if b == nil {
+		return nil, errors.New("Missing blobcache bucket")
+	}
+	return b, nil
+}
+
+func blobcache_val(flags byte, atime int64) []byte {
+	return append([]byte{flags}, uint64_b(uint64(atime))...)
+}
+
+// whether we have to keep blob hash
+func (f *FS) HasCustody(hash []byte) bool {
+	custody := true
+	f.db.View(func(tx *bolt.Tx) error {
+		bc, err := blobcache_index(tx)
+		if err != nil {
+			return err
+		}
+		v := bc.Get(hash)
+		custody = len(v) == 0 || v[0] & blob_custody != 0
+		return nil
+	})
+	return custody
+}
+
+// record whether we keep blob hash for the cluster
+func (f *FS) setCustody(hash []byte, custody bool) error {
+	flags := byte(0)
+	if custody {
+		flags = blob_custody
+	}
+	return f.db.Update(func(tx *bolt.Tx) error {
+		bc, err := blobcache_index(tx)
+		if err != nil {
+			return err
+		}
+		return bc.Put(hash, blobcache_val(flags, time.Now().Unix()))
+	})
+}
+
+// we stored blob hash ourselves, a cached copy of it becomes ours to keep
+func (f *FS) takeCustody(hash []byte) error {
+	if f.HasCustody(hash) {
+		return nil
+	}
+	return f.db.Update(func(tx *bolt.Tx) error {
+		bc, err := blobcache_index(tx)
+		if err != nil {
+			return err
+		}
+		return bc.Delete(hash)
+	})
+}
+
+// blob hash is being read
+func (f *FS) touchBlob(hash []byte) {
+	f.usemu.Lock()
+	defer f.usemu.Unlock()
+	f.blobuse[string(hash)] = time.Now().Unix()
+}
+
+// write out access times counted since the last time
+func (f *FS) flushBlobUse() error {
+	f.usemu.Lock()
+	use := f.blobuse
+	f.blobuse = map[string]int64{}
+	f.usemu.Unlock()
+
+	if len(use) == 0 {
+		return nil
+	}
+	return f.db.Update(func(tx *bolt.Tx) error {
+		bc, err := blobcache_index(tx)
+		if err != nil {
+			return err
+		}
+		for hash, atime := range use {
+			v := bc.Get([]byte(hash))
+			if len(v) == 0 {
+				// kept anyway
+				continue
+			}
+			err = bc.Put([]byte(hash), blobcache_val(v[0], atime))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// bytes in the blob store
+func (f *FS) blobUsage() (int64, error) {
+	list, err := ioutil.ReadDir(f.blobDir())
+	if err != nil {
+		return 0, err
+	}
+	var total int64
+	for _, fi := range list {
+		total += fi.Size()
+	}
+	return total, nil
+}
+
+type cachedBlob struct {
+	hash []byte
+	atime int64
+}
+
+type by_atime []cachedBlob
+
+func (l by_atime) Len() int { return len(l) }
+func (l by_atime) Swap(i, j int) { l[i], l[j] = l[j], l[i] }
+func (l by_atime) Less(i, j int) bool { return l[i].atime < l[j].atime }
+
+// drop least recently used blobs we don't have to keep until the store
+// fits in the cache cap.  returns how many bytes went.
+func (f *FS) Evict() (int64, error) {
+	if f.cacheMax <= 0 {
+		return 0, nil
+	}
+	err := f.flushBlobUse()
+	if err != nil {
+		return 0, err
+	}
+	total, err := f.blobUsage()
+	if err != nil {
+		return 0, err
+	}
+	if total <= f.cacheMax {
+		return 0, nil
+	}
+
+	pinned, err := f.PinnedBlobs()
+	if err != nil {
+		return 0, err
+	}
+
+	list := []cachedBlob{}
+	err = f.db.View(func(tx *bolt.Tx) error {
+		bc, err := blobcache_index(tx)
+		if err != nil {
+			return err
+		}
+		return bc.ForEach(func(k, v []byte) error {
+			if len(v) != 9 || v[0] & blob_custody != 0 || pinned[string(k)] {
+				return nil
+			}
+			list = append(list, cachedBlob{append([]byte{}, k...), int64(b_uint64(v[1:]))})
+			return nil
+		})
+	})
+	if err != nil {
+		return 0, err
+	}
+	sort.Sort(by_atime(list))
+
+	var freed int64
+	for _, b := range list {
+		if total - freed <= f.cacheMax {
+			break
+		}
+		err = f.db.Update(func(tx *bolt.Tx) error {
+			bc, err := blobcache_index(tx)
+			if err != nil {
+				return err
+			}
+			// stored here since, and ours now
+			v := bc.Get(b.hash)
+			if len(v) == 0 || v[0] & blob_custody != 0 {
+				return nil
+			}
+			fi, err := os.Stat(f.BlobPath(b.hash))
+			if err == nil {
+				// readers that have it open keep reading it
+				err = os.Remove(f.BlobPath(b.hash))
+				if err != nil {
+					return err
+				}
+				freed += fi.Size()
+			}
+			return bc.Delete(b.hash)
+		})
+		if err != nil {
+			return freed, err
+		}
+	}
+	return freed, nil
+}
+
+func (f *FS) SpawnEvictor() {
+	go func() {
+		for {
+			time.Sleep(cache_evict_every)
+			freed, err := f.Evict()
+			if err != nil {
+				log.Println("cache eviction error:", err)
+			} else if freed > 0 {
+				log.Println("cache evicted", freed, "bytes")
+			}
+		}
+	}()
+}
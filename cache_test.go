@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/boltdb/bolt"
+)
+
+// eviction goes by last access, oldest first
+func TestEvictOldestFirst(t *testing.T) {
+	f := testFS(t, 1)
+	atimes := []int64{3000, 1000, 2000}
+	hashes := [][]byte{}
+	for i, atime := range atimes {
+		hash, _, err := f.StoreBlob(bytes.NewReader(bytes.Repeat([]byte{byte(i + 1)}, 1024)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		hashes = append(hashes, hash)
+		err = f.db.Update(func(tx *bolt.Tx) error {
+			bc, err := blobcache_index(tx)
+			if err != nil {
+				return err
+			}
+			return bc.Put(hash, blobcache_val(0, atime))
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	f.cacheMax = 2 * 1024
+	freed, err := f.Evict()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if freed != 1024 {
+		t.Errorf("freed %d bytes, want 1024", freed)
+	}
+	for i, hash := range hashes {
+		if want := atimes[i] != 1000; f.HasBlob(hash) != want {
+			t.Errorf("blob last read at %d: kept %v, want %v", atimes[i], !want, want)
+		}
+	}
+
+	// reading it makes it the newest
+	f.touchBlob(hashes[2])
+	f.cacheMax = 1024
+	if _, err := f.Evict(); err != nil {
+		t.Fatal(err)
+	}
+	if f.HasBlob(hashes[0]) || !f.HasBlob(hashes[2]) {
+		t.Error("evicted the blob just read")
+	}
+}
+
+// writing content we only had a cached copy of makes it ours again
+func TestStoreTakesCustody(t *testing.T) {
+	f := testFS(t, 1)
+	data := bytes.Repeat([]byte{7}, 1024)
+	hash, _, err := f.storeBlob(bytes.NewReader(data), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.setCustody(hash, false); err != nil {
+		t.Fatal(err)
+	}
+	if f.HasCustody(hash) {
+		t.Fatal("fetched blob in our custody")
+	}
+
+	if _, _, err := f.StoreBlob(bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	if !f.HasCustody(hash) {
+		t.Error("stored blob still a cached copy")
+	}
+	f.cacheMax = 1
+	if _, err := f.Evict(); err != nil {
+		t.Fatal(err)
+	}
+	if !f.HasBlob(hash) {
+		t.Error("evicted a blob we stored")
+	}
+}
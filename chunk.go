@@ -0,0 +1,342 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"sort"
+	"sync"
+)
+
+/* CHUNKS
+
+file content is cut into chunks where a rolling (gear) hash of the bytes
+seen so far in the chunk hits chunk_mask, so a local edit only changes
+the chunks around it.  every chunk is a blob.  a manifest lists them in
+order, and is itself a blob:
+
+	magic "FBM1"
+	count (u32), then count * { sha256 (32 bytes), length (u64) }
+
+little endian.  a content reference is a kind byte and a sha256:
+
+	content_blob     the whole file is one blob (from before chunking)
+	content_manifest the hash is a manifest
+
+a bare sha256, 32 bytes, is a content_blob reference.
+*/
+
+const (
+	content_blob byte = iota
+	content_manifest
+)
+
+const manifest_magic = "FBM1"
+
+const chunk_min = 256 * 1024
+const chunk_max = 4 * 1024 * 1024
+const chunk_mask = 1<<20 - 1 // about 1MB past chunk_min on average
+
+var empty_ref = append([]byte{content_blob}, empty_hash...)
+
+// the gear table has to be the same on every node, so it comes from a
+// fixed seed rather than math/rand
+var gear [256]uint64
+
+func init() {
+	x := uint64(0x66756230)
+	for i := range gear {
+		// splitmix64
+		x += 0x9e3779b97f4a7c15
+		z := x
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		gear[i] = z ^ (z >> 31)
+	}
+}
+
+type chunker struct {
+	r *bufio.Reader
+	buf []byte
+}
+
+func newChunker(r io.Reader) *chunker {
+	return &chunker{r: bufio.NewReaderSize(r, 1024*1024), buf: make([]byte, 0, chunk_max)}
+}
+
+// the next chunk, valid until the next call.  io.EOF when done.
+func (c *chunker) Next() ([]byte, error) {
+	c.buf = c.buf[:0]
+	var h uint64
+	for len(c.buf) < chunk_max {
+		b, err := c.r.ReadByte()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		c.buf = append(c.buf, b)
+		h = h<<1 + gear[b]
+		if len(c.buf) >= chunk_min && h & chunk_mask == 0 {
+			break
+		}
+	}
+	if len(c.buf) == 0 {
+		return nil, io.EOF
+	}
+	return c.buf, nil
+}
+
+type chunkRef struct {
+	hash []byte
+	offset int64
+	length int64
+}
+
+func manifest_bytes(chunks []chunkRef) []byte {
+	buf := bytes.Buffer{}
+	buf.WriteString(manifest_magic)
+	binary.Write(&buf, binary.LittleEndian, uint32(len(chunks)))
+	for _, c := range chunks {
+		buf.Write(c.hash)
+		binary.Write(&buf, binary.LittleEndian, uint64(c.length))
+	}
+	return buf.Bytes()
+}
+
+func manifest_from_bytes(b []byte) ([]chunkRef, error) {
+	r := bytes.NewReader(b)
+	magic := make([]byte, len(manifest_magic))
+	_, err := io.ReadFull(r, magic)
+	if err != nil || string(magic) != manifest_magic {
+		return nil, errors.New("Bad manifest")
+	}
+	var n uint32
+	err = binary.Read(r, binary.LittleEndian, &n)
+	if err != nil {
+		return nil, err
+	}
+	if uint64(n) * (hash_len + 8) != uint64(r.Len()) {
+		return nil, errors.New("Bad manifest length")
+	}
+	chunks := make([]chunkRef, n)
+	var off int64
+	for i := range chunks {
+		chunks[i].hash = make([]byte, hash_len)
+		io.ReadFull(r, chunks[i].hash)
+		var l uint64
+		binary.Read(r, binary.LittleEndian, &l)
+		chunks[i].offset = off
+		chunks[i].length = int64(l)
+		off += int64(l)
+	}
+	return chunks, nil
+}
+
+// split a content reference
+func content_ref_split(ref []byte) (byte, []byte, error) {
+	switch len(ref) {
+	case hash_len:
+		return content_blob, ref, nil
+	case hash_len + 1:
+		if ref[0] > content_manifest {
+			return 0, nil, errors.New("Unknown content kind")
+		}
+		return ref[0], ref[1:], nil
+	}
+	return 0, nil, errors.New("Bad content reference")
+}
+
+// chunk r into the blob store, returns a manifest reference and the size
+func (f *FS) StoreChunked(r io.Reader) ([]byte, uint64, error) {
+	c := newChunker(r)
+	chunks := []chunkRef{}
+	var size int64
+	for {
+		data, err := c.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		hash, _, err := f.StoreBlob(bytes.NewReader(data))
+		if err != nil {
+			return nil, 0, err
+		}
+		chunks = append(chunks, chunkRef{hash: hash, offset: size, length: int64(len(data))})
+		size += int64(len(data))
+	}
+
+	mhash, _, err := f.StoreBlob(bytes.NewReader(manifest_bytes(chunks)))
+	if err != nil {
+		return nil, 0, err
+	}
+	return append([]byte{content_manifest}, mhash...), uint64(size), nil
+}
+
+func (f *FS) StoreChunkedFile(path string) ([]byte, uint64, error) {
+	fh, err := os.Open(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer fh.Close()
+	return f.StoreChunked(fh)
+}
+
+// the chunks of a content reference, a whole blob is one chunk.  fetches
+// the manifest or blob if we don't have it, see FETCHING.
+func (f *FS) chunksOf(ref []byte) ([]chunkRef, error) {
+	kind, hash, err := content_ref_split(ref)
+	if err != nil {
+		return nil, err
+	}
+	f2, err := f.openBlob(hash)
+	if err != nil {
+		return nil, err
+	}
+	defer f2.Close()
+	if kind == content_blob {
+		fi, err := f2.Stat()
+		if err != nil {
+			return nil, err
+		}
+		return []chunkRef{{hash: hash, length: fi.Size()}}, nil
+	}
+	b := bytes.Buffer{}
+	_, err = b.ReadFrom(f2)
+	if err != nil {
+		return nil, err
+	}
+	return manifest_from_bytes(b.Bytes())
+}
+
+// open blob hash for reading, fetching it if need be
+func (f *FS) openBlob(hash []byte) (*os.File, error) {
+	for tries := 0; ; tries++ {
+		err := f.ensureBlob(hash)
+		if err != nil {
+			return nil, err
+		}
+		fh, err := os.Open(f.BlobPath(hash))
+		if os.IsNotExist(err) && tries == 0 {
+			// evicted in between
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		f.touchBlob(hash)
+		return fh, nil
+	}
+}
+
+type contentFile interface {
+	io.ReaderAt
+	io.Closer
+}
+
+// reads sealed content chunk by chunk, keeping the last one open.
+// chunks we don't have are fetched as they are read.
+type contentReader struct {
+	fs *FS
+	chunks []chunkRef
+	size int64
+
+	mu sync.Mutex
+	cur int
+	curf *os.File
+}
+
+func (f *FS) OpenContent(ref []byte) (*contentReader, error) {
+	chunks, err := f.chunksOf(ref)
+	if err != nil {
+		return nil, err
+	}
+	cr := contentReader{fs: f, chunks: chunks, cur: -1}
+	if len(chunks) > 0 {
+		last := chunks[len(chunks) - 1]
+		cr.size = last.offset + last.length
+	}
+	f.openmu.Lock()
+	f.readers[&cr] = true
+	f.openmu.Unlock()
+	return &cr, nil
+}
+
+func (cr *contentReader) Size() int64 {
+	return cr.size
+}
+
+func (cr *contentReader) ReadAt(p []byte, off int64) (int, error) {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+
+	n := 0
+	for n < len(p) {
+		if off >= cr.size {
+			return n, io.EOF
+		}
+		i := sort.Search(len(cr.chunks), func(i int) bool {
+			return cr.chunks[i].offset + cr.chunks[i].length > off
+		})
+		if i != cr.cur {
+			if cr.curf != nil {
+				cr.curf.Close()
+				cr.curf = nil
+			}
+			fh, err := cr.fs.openBlob(cr.chunks[i].hash)
+			if err != nil {
+				return n, err
+			}
+			cr.cur = i
+			cr.curf = fh
+		}
+		c := cr.chunks[i]
+		want := p[n:]
+		if int64(len(want)) > c.offset + c.length - off {
+			want = want[:c.offset + c.length - off]
+		}
+		m, err := cr.curf.ReadAt(want, off - c.offset)
+		n += m
+		off += int64(m)
+		if err == io.EOF && m == len(want) {
+			err = nil
+		}
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+func (cr *contentReader) Close() error {
+	cr.fs.openmu.Lock()
+	delete(cr.fs.readers, cr)
+	cr.fs.openmu.Unlock()
+
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	if cr.curf != nil {
+		err := cr.curf.Close()
+		cr.curf = nil
+		cr.cur = -1
+		return err
+	}
+	return nil
+}
+
+// write out a whole content reference
+func (f *FS) CopyContent(ref []byte, w io.Writer) error {
+	cr, err := f.OpenContent(ref)
+	if err != nil {
+		return err
+	}
+	defer cr.Close()
+	_, err = io.Copy(w, io.NewSectionReader(cr, 0, cr.Size()))
+	return err
+}
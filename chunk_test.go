@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+func testData(seed int64, n int) []byte {
+	data := make([]byte, n)
+	rand.New(rand.NewSource(seed)).Read(data)
+	return data
+}
+
+func TestChunkerBounds(t *testing.T) {
+	data := testData(1, 24 << 20)
+	c := newChunker(bytes.NewReader(data))
+	var got []byte
+	var sizes []int
+	for {
+		chunk, err := c.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, chunk...)
+		sizes = append(sizes, len(chunk))
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("chunks don't add up to the input")
+	}
+	if len(sizes) < 4 {
+		t.Errorf("%d chunks for 24MB", len(sizes))
+	}
+	for i, n := range sizes {
+		if n > chunk_max || (n < chunk_min && i != len(sizes) - 1) {
+			t.Errorf("chunk %d has %d bytes", i, n)
+		}
+	}
+
+	// all zeros never hits the mask, so chunk_max cuts it
+	c = newChunker(bytes.NewReader(make([]byte, chunk_max + 1)))
+	if chunk, _ := c.Next(); len(chunk) != chunk_max {
+		t.Errorf("first chunk of zeros has %d bytes", len(chunk))
+	}
+	if chunk, _ := c.Next(); len(chunk) != 1 {
+		t.Errorf("second chunk of zeros has %d bytes", len(chunk))
+	}
+	if _, err := c.Next(); err != io.EOF {
+		t.Errorf("after the end: %v", err)
+	}
+}
+
+func testChunks(t *testing.T, f *FS, ref []byte) []chunkRef {
+	chunks, err := f.chunksOf(ref)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return chunks
+}
+
+func TestStoreChunkedRoundTrip(t *testing.T) {
+	f := testFS(t, 1)
+	data := testData(2, 12 << 20)
+	ref, size, err := f.StoreChunked(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != uint64(len(data)) || ref[0] != content_manifest {
+		t.Fatalf("ref %x, size %d", ref, size)
+	}
+	chunks := testChunks(t, f, ref)
+	if len(chunks) < 2 {
+		t.Fatalf("%d chunks", len(chunks))
+	}
+
+	cr, err := f.OpenContent(ref)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cr.Close()
+	if cr.Size() != int64(len(data)) {
+		t.Errorf("size %d", cr.Size())
+	}
+	// across every boundary, backwards so each read reopens chunks
+	for i := len(chunks) - 1; i > 0; i-- {
+		off := chunks[i].offset - 100
+		buf := make([]byte, 200)
+		n, err := cr.ReadAt(buf, off)
+		if err != nil || n != 200 || !bytes.Equal(buf, data[off:off + 200]) {
+			t.Errorf("read %d bytes at %d across chunk %d: %v", n, off, i, err)
+		}
+	}
+	// past the end
+	buf := make([]byte, 100)
+	n, err := cr.ReadAt(buf, int64(len(data)) - 50)
+	if n != 50 || err != io.EOF || !bytes.Equal(buf[:50], data[len(data) - 50:]) {
+		t.Errorf("read %d bytes at the end: %v", n, err)
+	}
+
+	out := bytes.Buffer{}
+	if err := f.CopyContent(ref, &out); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out.Bytes(), data) {
+		t.Error("copied content differs")
+	}
+}
+
+// a one byte edit only changes the chunks around it
+func TestChunkOneByteEdit(t *testing.T) {
+	f := testFS(t, 1)
+	data := testData(3, 16 << 20)
+	ref, _, err := f.StoreChunked(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	edited := append([]byte{}, data...)
+	edited[len(edited) / 2] ^= 0xff
+	ref2, _, err := f.StoreChunked(bytes.NewReader(edited))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(ref, ref2) {
+		t.Fatal("same reference for different content")
+	}
+
+	before := map[string]bool{}
+	for _, c := range testChunks(t, f, ref) {
+		before[string(c.hash)] = true
+	}
+	after := testChunks(t, f, ref2)
+	changed := 0
+	for _, c := range after {
+		if !before[string(c.hash)] {
+			changed++
+		}
+	}
+	if changed == 0 || changed > 2 {
+		t.Errorf("%d of %d chunks changed", changed, len(after))
+	}
+}
+
+func TestManifestCodec(t *testing.T) {
+	chunks := []chunkRef{
+		{hash: bytes.Repeat([]byte{1}, hash_len), offset: 0, length: 300000},
+		{hash: bytes.Repeat([]byte{2}, hash_len), offset: 300000, length: 1},
+		{hash: bytes.Repeat([]byte{3}, hash_len), offset: 300001, length: chunk_max},
+	}
+	b := manifest_bytes(chunks)
+	got, err := manifest_from_bytes(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, chunks) {
+		t.Errorf("read %+v, want %+v", got, chunks)
+	}
+	if got, err := manifest_from_bytes(manifest_bytes(nil)); err != nil || len(got) != 0 {
+		t.Errorf("empty manifest: %v, %v", got, err)
+	}
+
+	for i := 0; i < len(b); i++ {
+		if _, err := manifest_from_bytes(b[:i]); err == nil {
+			t.Errorf("took %d of %d bytes", i, len(b))
+		}
+	}
+	if _, err := manifest_from_bytes(append(b, 0)); err == nil {
+		t.Error("took a trailing byte")
+	}
+	bad := append([]byte{}, b...)
+	bad[0] = 'X'
+	if _, err := manifest_from_bytes(bad); err == nil {
+		t.Error("took a bad magic")
+	}
+}
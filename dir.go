@@ -4,6 +4,7 @@ import (
 	"bazil.org/fuse"
 	"bazil.org/fuse/fs"
 	"os"
+	"path"
 	"errors"
 	"syscall"
 	"github.com/boltdb/bolt"
@@ -21,7 +22,25 @@ type Dir struct {
 
 func (d Dir) Attr() fuse.Attr {
 	//(d.inode, "dattr")
-	return fuse.Attr{Inode: d.inode, Mode: os.ModeDir | 0555}
+	attr := fuse.Attr{Inode: d.inode, Mode: os.ModeDir | 0755}
+	d.fs.db.View(func(tx *bolt.Tx) error {
+		a, err := load_attr(tx, d.inode)
+		if err != nil {
+			return err
+		}
+		a.fill(&attr)
+		return nil
+	})
+	return attr
+}
+
+func (d Dir) Setattr(req *fuse.SetattrRequest, resp *fuse.SetattrResponse, intr fs.Intr) fuse.Error {
+	err := d.fs.Setattr(d.inode, req)
+	if err != nil {
+		return err
+	}
+	resp.Attr = d.Attr()
+	return nil
 }
 
 func (d Dir) Lookup(name string, intr fs.Intr) (fs.Node, fuse.Error) {
@@ -30,10 +49,6 @@ func (d Dir) Lookup(name string, intr fs.Intr) (fs.Node, fuse.Error) {
 	var r fs.Node
 
 	err := d.fs.db.View(func(tx *bolt.Tx) error {
-		fsizes := tx.Bucket([]byte("filesize"))
-		if fsizes == nil {
-			return errors.New("Missing filesize bucket")
-		}
 		kids := tx.Bucket([]byte("kids"))
 		if kids == nil {
 			return errors.New("Missing kids bucket")
@@ -46,16 +61,31 @@ func (d Dir) Lookup(name string, intr fs.Intr) (fs.Node, fuse.Error) {
 		if match == nil {
 			return fuse.ENOENT
 		}
+		visible, err := d.fs.Visible(tx, d.inode, []byte(name))
+		if err != nil {
+			return err
+		}
+		if !visible {
+			return fuse.ENOENT
+		}
 		inode := b_uint64(match)
 		if inode == 0 {
 			return fuse.ENOENT
 		}
-		fsizev := fsizes.Get(match)
-		//log.Println(inode, "lookup size", b_uint64(fsizev))
-		if fsizev == nil {
-			r = Dir{inode: inode, fs: d.fs}
-		} else {
+		typ, err := inode_type(tx, inode)
+		if err != nil {
+			return err
+		}
+		switch typ {
+		case inode_file:
 			r = File{inode: inode, fs: d.fs}
+		case inode_dir:
+			r = Dir{inode: inode, fs: d.fs}
+		case inode_symlink:
+			r = Symlink{inode: inode, fs: d.fs}
+		default:
+			log.Println(inode, "named", name, "has no inode record")
+			return fuse.Errno(syscall.EIO)
 		}
 		return nil
 	})
@@ -72,10 +102,6 @@ func (d Dir) ReadDir(intr fs.Intr) ([]fuse.Dirent, fuse.Error) {
 	list := []fuse.Dirent{}
 
 	err := d.fs.db.View(func(tx *bolt.Tx) error {
-		fsizes := tx.Bucket([]byte("filesize"))
-		if fsizes == nil {
-			return errors.New("Missing filesize bucket")
-		}
 		kids := tx.Bucket([]byte("kids"))
 		if kids == nil {
 			return errors.New("Missing kids bucket")
@@ -84,17 +110,32 @@ func (d Dir) ReadDir(intr fs.Intr) ([]fuse.Dirent, fuse.Error) {
 		if dkids == nil {
 			return errors.New("Missing directory kids bucket")
 		}
-		dkids.ForEach(func(k, v []byte) error {
+		return dkids.ForEach(func(k, v []byte) error {
 			name := string(k)
 			inode := b_uint64(v)
 
-			fsize := fsizes.Get(v)
-			typ := fuse.DT_Dir
-			if fsize != nil {
+			visible, err := d.fs.Visible(tx, d.inode, k)
+			if err != nil {
+				return err
+			}
+			if !visible {
+				return nil
+			}
+
+			itype, err := inode_type(tx, inode)
+			if err != nil {
+				return err
+			}
+			typ := fuse.DT_Unknown
+			switch itype {
+			case inode_file:
 				typ = fuse.DT_File
+			case inode_dir:
+				typ = fuse.DT_Dir
+			case inode_symlink:
+				typ = fuse.DT_Link
 			}
 
-			//log.Println(inode, "dirent size", b_uint64(fsize))
 			list = append(list, fuse.Dirent{
 				Inode: inode,
 				Name: name,
@@ -102,7 +143,6 @@ func (d Dir) ReadDir(intr fs.Intr) ([]fuse.Dirent, fuse.Error) {
 			})
 			return nil
 		})
-		return nil
 	})
 	if err != nil {
 		return nil, err
@@ -112,10 +152,25 @@ func (d Dir) ReadDir(intr fs.Intr) ([]fuse.Dirent, fuse.Error) {
 }
 
 
+// renameat2 flags, for rename.  bazil.org/fuse doesn't pass them on, so
+// only the admin console's MVNX and SWAP get to use them.
+const (
+	rename_noreplace uint32 = 1 << iota
+	rename_exchange
+)
+
 func (d Dir) Rename(req *fuse.RenameRequest, newDir fs.Node, intr fs.Intr) fuse.Error {
 	//log.Println(d.inode, "rename")
+	return d.rename(req.OldName, newDir.Attr().Inode, req.NewName, 0)
+}
 
-	if req.NewName == req.OldName && newDir.Attr().Inode == d.inode {
+// move old_name to new_name in new_dir_inode, replacing what is there
+// like rename(2), or as renameat2(2) with flags
+func (d Dir) rename(old_name string, new_dir_inode uint64, new_name string, flags uint32) error {
+	if flags & rename_noreplace != 0 && flags & rename_exchange != 0 {
+		return fuse.Errno(syscall.EINVAL)
+	}
+	if new_name == old_name && new_dir_inode == d.inode {
 		// seems to be a noop
 		return nil
 	}
@@ -129,14 +184,29 @@ func (d Dir) Rename(req *fuse.RenameRequest, newDir fs.Node, intr fs.Intr) fuse.
 		if dkids == nil {
 			return errors.New("Missing directory kids bucket")
 		}
-		key := []byte(req.OldName)
+		key := []byte(old_name)
 		exists := dkids.Get(key)
 		if exists == nil {
 			return fuse.Errno(syscall.ENOENT)
 		}
-
-		// put it into the new folder before we remove it from the old one
-		new_dir_inode := newDir.Attr().Inode
+		// bolt values are only valid until the next write
+		exists = append([]byte{}, exists...)
+		inode := b_uint64(exists)
+		visible, err := d.fs.Visible(tx, d.inode, key)
+		if err != nil {
+			return err
+		}
+		if !visible {
+			return fuse.Errno(syscall.ENOENT)
+		}
+		logname, err := d.fs.LogName(tx, d.inode, key)
+		if err != nil {
+			return err
+		}
+		zombie, err := d.fs.ZombieDbid(tx, d.inode, key)
+		if err != nil {
+			return err
+		}
 
 		var ndkids *bolt.Bucket
 		if new_dir_inode == d.inode {
@@ -147,26 +217,265 @@ func (d Dir) Rename(req *fuse.RenameRequest, newDir fs.Node, intr fs.Intr) fuse.
 				return errors.New("Missing new directory kids bucket")
 			}
 		}
+		newkey := []byte(new_name)
 
-		newkey := []byte(req.NewName)
+		// a directory can't go under itself
+		typ, err := inode_type(tx, inode)
+		if err != nil {
+			return err
+		}
+		isdir := typ == inode_dir
+		if isdir && new_dir_inode != d.inode {
+			under, err := d.fs.isUnder(tx, new_dir_inode, inode)
+			if err != nil {
+				return err
+			}
+			if under {
+				return fuse.Errno(syscall.EINVAL)
+			}
+		}
 
-		err := ndkids.Put(newkey, exists)
+		// what is at the new name.  another database's zombie we can't
+		// see moves aside and stays hidden.
+		var target []byte
+		if v := ndkids.Get(newkey); v != nil {
+			target = append([]byte{}, v...)
+			visible, err := d.fs.Visible(tx, new_dir_inode, newkey)
+			if err != nil {
+				return err
+			}
+			if !visible {
+				err = d.fs.moveZombie(tx, new_dir_inode, ndkids, newkey)
+				if err != nil {
+					return err
+				}
+				target = nil
+			}
+		}
+
+		if flags & rename_exchange != 0 {
+			if target == nil {
+				return fuse.Errno(syscall.ENOENT)
+			}
+			return d.exchange(tx, key, inode, logname, zombie, new_dir_inode, ndkids, newkey, b_uint64(target))
+		}
+
+		var tlogname []byte
+		var tzombie uint16
+		if target != nil {
+			if flags & rename_noreplace != 0 {
+				return fuse.Errno(syscall.EEXIST)
+			}
+			if b_uint64(target) == inode {
+				// two names of the same file, nothing to do
+				return nil
+			}
+			ttyp, err := inode_type(tx, b_uint64(target))
+			if err != nil {
+				return err
+			}
+			tisdir := ttyp == inode_dir
+			if isdir && !tisdir {
+				return fuse.Errno(syscall.ENOTDIR)
+			}
+			if !isdir && tisdir {
+				return fuse.Errno(syscall.EISDIR)
+			}
+			if tisdir {
+				empty, err := d.fs.dirEmpty(tx, b_uint64(target))
+				if err != nil {
+					return err
+				}
+				if !empty {
+					return fuse.Errno(syscall.ENOTEMPTY)
+				}
+			}
+			tlogname, err = d.fs.LogName(tx, new_dir_inode, newkey)
+			if err != nil {
+				return err
+			}
+			tzombie, err = d.fs.ZombieDbid(tx, new_dir_inode, newkey)
+			if err != nil {
+				return err
+			}
+		}
+
+		// put it into the new folder before we remove it from the old one
+		err = kid_put(tx, ndkids, new_dir_inode, newkey, exists)
 		if err != nil {
 			return err
 		}
+		err = d.fs.unlinkedName(tx, new_dir_inode, ndkids, newkey)
+		if err != nil {
+			return err
+		}
+
+		err = kid_delete(tx, dkids, d.inode, key)
+		if err != nil {
+			return err
+		}
+		err = d.fs.unlinkedName(tx, d.inode, dkids, key)
+		if err != nil {
+			return err
+		}
+
+		if target != nil {
+			// replaced, logged as removed before the rename
+			err = d.fs.removedEntry(tx, new_dir_inode, tlogname, tzombie, b_uint64(target))
+			if err != nil {
+				return err
+			}
+		}
+
+		if zombie != 0 {
+			// the hidden copies go, and it comes back as new
+			err = d.fs.logRemove(tx, d.inode, logname, inode)
+			if err != nil {
+				return err
+			}
+			return d.fs.resurrect(tx, new_dir_inode, newkey, inode)
+		}
 
-		err = dkids.Delete(key)
+		_, err = d.fs.NewTx(tx, TX_RENAME, d.inode, logname, new_dir_inode, newkey, inode)
 		if err != nil {
 			return err
 		}
 
-		//inode := b_uint64(exists)
-		//log.Println(inode, "moved from", d.inode, "to", new_dir_inode, "name from", req.OldName, "to", req.NewName)
+		//log.Println(inode, "moved from", d.inode, "to", new_dir_inode, "name from", old_name, "to", new_name)
 
 		return nil
 	})
 }
 
+// swap two entries for RENAME_EXCHANGE.  peers would take either name
+// still being there for a conflict, so the log goes through a temporary
+// name.
+func (d Dir) exchange(tx *bolt.Tx, key []byte, inode uint64, logname []byte, zombie uint16, new_dir_inode uint64, ndkids *bolt.Bucket, newkey []byte, target uint64) error {
+	if target == inode {
+		return nil
+	}
+	kids := tx.Bucket([]byte("kids"))
+	if kids == nil {
+		return errors.New("Missing kids bucket")
+	}
+	dkids := kids.Bucket(uint64_b(d.inode))
+	if dkids == nil {
+		return errors.New("Missing directory kids bucket")
+	}
+	tzombie, err := d.fs.ZombieDbid(tx, new_dir_inode, newkey)
+	if err != nil {
+		return err
+	}
+	if zombie != 0 || tzombie != 0 {
+		// they would have to be created again, not moved
+		return fuse.Errno(syscall.EINVAL)
+	}
+
+	// neither may end up under itself
+	if new_dir_inode != d.inode {
+		typ, err := inode_type(tx, inode)
+		if err != nil {
+			return err
+		}
+		if typ == inode_dir {
+			under, err := d.fs.isUnder(tx, new_dir_inode, inode)
+			if err != nil || under {
+				return or_errno(err, syscall.EINVAL)
+			}
+		}
+		ttyp, err := inode_type(tx, target)
+		if err != nil {
+			return err
+		}
+		if ttyp == inode_dir {
+			under, err := d.fs.isUnder(tx, d.inode, target)
+			if err != nil || under {
+				return or_errno(err, syscall.EINVAL)
+			}
+		}
+	}
+
+	tlogname, err := d.fs.LogName(tx, new_dir_inode, newkey)
+	if err != nil {
+		return err
+	}
+
+	err = kid_put(tx, dkids, d.inode, key, uint64_b(target))
+	if err != nil {
+		return err
+	}
+	err = kid_put(tx, ndkids, new_dir_inode, newkey, uint64_b(inode))
+	if err != nil {
+		return err
+	}
+	err = d.fs.unlinkedName(tx, d.inode, dkids, key)
+	if err != nil {
+		return err
+	}
+	err = d.fs.unlinkedName(tx, new_dir_inode, ndkids, newkey)
+	if err != nil {
+		return err
+	}
+
+	tmp := []byte(fmt.Sprintf(".exchange.%d", inode))
+	_, err = d.fs.NewTx(tx, TX_RENAME, d.inode, logname, new_dir_inode, tmp, inode)
+	if err != nil {
+		return err
+	}
+	_, err = d.fs.NewTx(tx, TX_RENAME, new_dir_inode, tlogname, d.inode, key, target)
+	if err != nil {
+		return err
+	}
+	_, err = d.fs.NewTx(tx, TX_RENAME, new_dir_inode, tmp, new_dir_inode, newkey, inode)
+	return err
+}
+
+// err, or errno if there was none
+func or_errno(err error, errno syscall.Errno) error {
+	if err != nil {
+		return err
+	}
+	return fuse.Errno(errno)
+}
+
+// rename by path from the root, for the admin console
+func (f *FS) RenamePath(old_path string, new_path string, flags uint32) error {
+	odir, oname := path.Split(path.Clean("/" + old_path))
+	ndir, nname := path.Split(path.Clean("/" + new_path))
+	if oname == "" || nname == "" {
+		return fuse.Errno(syscall.EINVAL)
+	}
+	oinode, err := f.ResolvePath(odir)
+	if err != nil {
+		return err
+	}
+	ninode, err := f.ResolvePath(ndir)
+	if err != nil {
+		return err
+	}
+	if f.InodeType(oinode) != inode_dir || f.InodeType(ninode) != inode_dir {
+		return fuse.Errno(syscall.ENOTDIR)
+	}
+	return Dir{inode: oinode, fs: f}.rename(oname, ninode, nname, flags)
+}
+
+// whether directory inode is dir or somewhere below it
+func (f *FS) isUnder(tx *bolt.Tx, inode uint64, dir uint64) (bool, error) {
+	seen := map[uint64]bool{}
+	for inode != 0 && !seen[inode] {
+		if inode == dir {
+			return true, nil
+		}
+		seen[inode] = true
+		var err error
+		inode, _, err = parent_of(tx, inode)
+		if err != nil {
+			return false, err
+		}
+	}
+	return false, nil
+}
+
 func (d Dir) Remove(req *fuse.RemoveRequest, intr fs.Intr) fuse.Error {
 	//log.Println(d.inode, "remove", req.Name)
 
@@ -184,12 +493,103 @@ func (d Dir) Remove(req *fuse.RemoveRequest, intr fs.Intr) fuse.Error {
 		if exists == nil {
 			return fuse.Errno(syscall.ENOENT)
 		}
-		//inode := b_uint64(exists)
+		inode := b_uint64(exists)
+		visible, err := d.fs.Visible(tx, d.inode, key)
+		if err != nil {
+			return err
+		}
+		if !visible {
+			return fuse.Errno(syscall.ENOENT)
+		}
+
+		// rmdir only takes empty directories, unlink never takes one
+		typ, err := inode_type(tx, inode)
+		if err != nil {
+			return err
+		}
+		isdir := typ == inode_dir
+		if req.Dir && !isdir {
+			return fuse.Errno(syscall.ENOTDIR)
+		}
+		if !req.Dir && isdir {
+			return fuse.Errno(syscall.EISDIR)
+		}
+		if isdir {
+			empty, err := d.fs.dirEmpty(tx, inode)
+			if err != nil {
+				return err
+			}
+			if !empty {
+				return fuse.Errno(syscall.ENOTEMPTY)
+			}
+		}
+
 		//log.Println(inode, "removed")
-		return dkids.Delete(key)
+		logname, err := d.fs.LogName(tx, d.inode, key)
+		if err != nil {
+			return err
+		}
+		zombie, err := d.fs.ZombieDbid(tx, d.inode, key)
+		if err != nil {
+			return err
+		}
+		err = kid_delete(tx, dkids, d.inode, key)
+		if err != nil {
+			return err
+		}
+		err = d.fs.unlinkedName(tx, d.inode, dkids, key)
+		if err != nil {
+			return err
+		}
+		return d.fs.removedEntry(tx, d.inode, logname, zombie, inode)
 	})
 }
 
+// the entry logname of dir, for inode, is gone: unlink it and log the
+// removal
+func (f *FS) removedEntry(tx *bolt.Tx, dir uint64, logname []byte, zombie uint16, inode uint64) error {
+	// someone else's zombie is theirs to give up.  logged first,
+	// reclaiming inode forgets its oid.
+	if zombie == 0 || zombie == f.dbid {
+		err := f.logRemove(tx, dir, logname, inode)
+		if err != nil {
+			return err
+		}
+	}
+	return f.unlinkInode(tx, inode)
+}
+
+func (f *FS) logRemove(tx *bolt.Tx, dir uint64, logname []byte, inode uint64) error {
+	// what we had seen, so whoever changed it since keeps a zombie
+	marks, err := f.TxMarks(tx)
+	if err != nil {
+		return err
+	}
+	_, err = f.NewTx(tx, TX_REMOVE, dir, logname, 0, tx_marks_bytes(marks), inode)
+	return err
+}
+
+// whether dir has nothing we can see.  zombies of other databases are
+// gone as far as we are concerned, and go with it.
+func (f *FS) dirEmpty(tx *bolt.Tx, dir uint64) (bool, error) {
+	kids := tx.Bucket([]byte("kids"))
+	if kids == nil {
+		return false, errors.New("Missing kids bucket")
+	}
+	dkids := kids.Bucket(uint64_b(dir))
+	if dkids == nil {
+		return false, errors.New("Missing directory kids bucket")
+	}
+	c := dkids.Cursor()
+	for k, _ := c.First(); k != nil; k, _ = c.Next() {
+		visible, err := f.Visible(tx, dir, k)
+		if err != nil || visible {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
 func (d Dir) Mkdir(req *fuse.MkdirRequest, intr fs.Intr) (fs.Node, fuse.Error) {
 	//log.Println(d.inode, "mkdir", req.Name)
 
@@ -215,7 +615,7 @@ func (d Dir) Mkdir(req *fuse.MkdirRequest, intr fs.Intr) (fs.Node, fuse.Error) {
 		}
 
 		val := uint64_b(inode)
-		err = dkids.Put(key, val)
+		err = kid_put(tx, dkids, d.inode, key, val)
 		if err != nil {
 			return err
 		}
@@ -224,11 +624,14 @@ func (d Dir) Mkdir(req *fuse.MkdirRequest, intr fs.Intr) (fs.Node, fuse.Error) {
 			return err
 		}
 
-		txn, err := d.fs.NewTx(tx, TX_MKDIR, d.inode, key, 0, nil)
+		_, err = d.fs.NewTx(tx, TX_MKDIR, d.inode, key, inode, nil, inode)
+		if err != nil {
+			return err
+		}
+		err = d.fs.initInode(tx, inode, inode_dir, req.Mode, req.Header)
 		if err != nil {
 			return err
 		}
-		_ = txn
 
 		child = &Dir{inode: inode, fs: d.fs}
 		return nil
@@ -247,12 +650,8 @@ func (d Dir) Create(req *fuse.CreateRequest, resp *fuse.CreateResponse, intr fs.
 	//log.Println("create request, flags", req.Flags, "mode", req.Mode)
 
 	var child fs.Node
-	var handle fs.Handle
+	var fh *os.File
 	err := d.fs.db.Update(func(tx *bolt.Tx) error {
-		fsizes := tx.Bucket([]byte("filesize"))
-		if fsizes == nil {
-			return errors.New("Missing filesize bucket")
-		}
 		kids := tx.Bucket([]byte("kids"))
 		if kids == nil {
 			return errors.New("Missing kids bucket")
@@ -273,25 +672,150 @@ func (d Dir) Create(req *fuse.CreateRequest, resp *fuse.CreateResponse, intr fs.
 		}
 
 		val := uint64_b(inode)
-		dkids.Put(key, val)
-		fsizes.Put(val, uint64_b(0))
+		err = kid_put(tx, dkids, d.inode, key, val)
+		if err != nil {
+			return err
+		}
+
+		_, err = d.fs.NewTx(tx, TX_CREATE, d.inode, key, inode, nil, inode)
+		if err != nil {
+			return err
+		}
+		err = d.fs.initInode(tx, inode, inode_file, req.Mode, req.Header)
+		if err != nil {
+			return err
+		}
+
+		// the staging copy comes first, so once the file exists opening
+		// it can't fail
+		fh, err = d.fs.newStaging(inode, true)
+		if err != nil {
+			return err
+		}
 
 		//log.Println(inode, "created")
 
 		newfile := File{inode: inode, fs: d.fs}
 		child = &newfile
+		return nil
+	})
+	if err != nil {
+		if fh != nil {
+			fh.Close()
+			os.Remove(fh.Name())
+		}
+		return nil, nil, err
+	}
+
+	return child, newCreatedHandle(child.(*File), req.Flags, fh), nil
+}
 
-		handle, err = NewHandle(&newfile, req.Flags)
+func (d Dir) Link(req *fuse.LinkRequest, old fs.Node, intr fs.Intr) (fs.Node, fuse.Error) {
+	//log.Println(d.inode, "link", req.NewName)
+
+	target := old.Attr().Inode
+
+	err := d.fs.db.Update(func(tx *bolt.Tx) error {
+		kids := tx.Bucket([]byte("kids"))
+		if kids == nil {
+			return errors.New("Missing kids bucket")
+		}
+		typ, err := inode_type(tx, target)
 		if err != nil {
 			return err
 		}
-		return nil
+		if typ == inode_dir {
+			// no hard links to directories
+			return fuse.Errno(syscall.EPERM)
+		}
+		dkids := kids.Bucket(uint64_b(d.inode))
+		if dkids == nil {
+			return errors.New("Missing directory kids bucket")
+		}
+		key := []byte(req.NewName)
+		if dkids.Get(key) != nil {
+			return fuse.Errno(syscall.EEXIST)
+		}
+		n, err := d.fs.Nlink(tx, target)
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			// unlinked while open
+			return fuse.ENOENT
+		}
+
+		err = kid_put(tx, dkids, d.inode, key, uint64_b(target))
+		if err != nil {
+			return err
+		}
+		err = d.fs.setNlink(tx, target, n + 1)
+		if err != nil {
+			return err
+		}
+		_, err = d.fs.NewTx(tx, TX_LINK, d.inode, key, target, nil, target)
+		return err
 	})
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := old.(Symlink); ok {
+		return old, nil
+	}
+	return File{inode: target, fs: d.fs}, nil
+}
+
+func (d Dir) Symlink(req *fuse.SymlinkRequest, intr fs.Intr) (fs.Node, fuse.Error) {
+	//log.Println(d.inode, "symlink", req.NewName, "->", req.Target)
 
+	var child fs.Node
+	err := d.fs.db.Update(func(tx *bolt.Tx) error {
+		symlinks := tx.Bucket([]byte("symlinks"))
+		if symlinks == nil {
+			return errors.New("Missing symlinks bucket")
+		}
+		kids := tx.Bucket([]byte("kids"))
+		if kids == nil {
+			return errors.New("Missing kids bucket")
+		}
+		dkids := kids.Bucket(uint64_b(d.inode))
+		if dkids == nil {
+			return errors.New("Missing directory kids bucket")
+		}
+		key := []byte(req.NewName)
+		if dkids.Get(key) != nil {
+			return fuse.Errno(syscall.EEXIST)
+		}
+
+		inode, err := d.fs.NewInode(tx)
+		if err != nil {
+			return err
+		}
+		val := uint64_b(inode)
+		err = symlinks.Put(val, []byte(req.Target))
+		if err != nil {
+			return err
+		}
+		err = kid_put(tx, dkids, d.inode, key, val)
+		if err != nil {
+			return err
+		}
+		_, err = d.fs.NewTx(tx, TX_SYMLINK, d.inode, key, inode, []byte(req.Target), inode)
+		if err != nil {
+			return err
+		}
+		err = d.fs.initInode(tx, inode, inode_symlink, 0777, req.Header)
+		if err != nil {
+			return err
+		}
+
+		child = Symlink{inode: inode, fs: d.fs}
+		return nil
+	})
 	if err != nil {
-		return nil, nil, err
+		return nil, err
 	}
-	return child, handle, err
+	return child, nil
 }
 
 func (d Dir) Listxattr(req *fuse.ListxattrRequest, resp *fuse.ListxattrResponse, intr fs.Intr) fuse.Error {
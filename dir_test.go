@@ -0,0 +1,65 @@
+package main
+
+import (
+	"syscall"
+	"testing"
+
+	"bazil.org/fuse"
+)
+
+// rmdir only takes empty directories, unlink never takes one
+func TestRemoveTypes(t *testing.T) {
+	f := testFS(t, 1)
+	root := Dir{inode: root_inode, fs: f}
+	d := testMkdir(t, root, "d")
+	testCreate(t, d, "f", "data")
+	for _, c := range []struct {
+		dir Dir
+		name string
+		rmdir bool
+		want error
+	}{
+		{root, "d", true, fuse.Errno(syscall.ENOTEMPTY)},
+		{root, "d", false, fuse.Errno(syscall.EISDIR)},
+		{d, "f", true, fuse.Errno(syscall.ENOTDIR)},
+		{root, "none", true, fuse.Errno(syscall.ENOENT)},
+		{root, "none", false, fuse.Errno(syscall.ENOENT)},
+	} {
+		err := c.dir.Remove(&fuse.RemoveRequest{Name: c.name, Dir: c.rmdir}, nil)
+		if err != c.want {
+			t.Errorf("remove %s, dir %v: %v, want %v", c.name, c.rmdir, err, c.want)
+		}
+	}
+	checkNames(t, "root", root, "d")
+	checkNames(t, "d", d, "f")
+
+	testUnlink(t, d, "f")
+	testRmdir(t, root, "d")
+	checkNames(t, "root", root)
+}
+
+// another database's zombie doesn't keep a directory from going
+func TestRmdirHiddenZombie(t *testing.T) {
+	a := testFS(t, 1)
+	b := testFS(t, 2)
+	c := testFS(t, 3)
+	ra := Dir{inode: root_inode, fs: a}
+	rc := Dir{inode: root_inode, fs: c}
+
+	testMkdir(t, testMkdir(t, ra, "p"), "d")
+	testSync(t, a, b)
+	testSync(t, a, c)
+	rb := Dir{inode: root_inode, fs: b}
+	testMkdir(t, testLookupDir(t, testLookupDir(t, rb, "p"), "d"), "x")
+	testSync(t, b, c)
+	testRmdir(t, testLookupDir(t, ra, "p"), "d")
+	testSync(t, a, c)
+
+	p := testLookupDir(t, rc, "p")
+	if !hasEntry(t, c, p.inode, "d-ZOMBIE") {
+		t.Fatal("no hidden zombie")
+	}
+	checkNames(t, "c p", p)
+	testRmdir(t, rc, "p")
+	checkNames(t, "c", rc)
+}
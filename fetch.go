@@ -0,0 +1,427 @@
+package main
+
+import (
+	"bazil.org/fuse"
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+)
+
+/* FETCHING
+
+replicated metadata arrives long before anyone wants the bytes, so a
+file's content reference can name blobs we don't have.  opening or
+reading such a file fetches the manifest, then each chunk as it is
+read, from the peers we have a sync connection with.
+
+blobs are asked for on a fetch connection, which opens with the usual
+hellos and then carries requests one at a time:
+
+	request: sha256 (32 bytes), wants custody (byte, 1 or 0)
+	answer:  found (byte: 0 not found, 1 found, 2 found and custody is
+	         yours), and if found length (u64) and the blob
+	ack:     after an answer of 2, stored (byte, 1 or 0)
+
+little endian.  whoever dials a peer for sync can dial it again with a
+hello of purpose repl_fetch when it first needs a blob, and asks on that.
+the dialed side can't dial back, so right after the sync hellos the
+dialer also opens a connection of purpose repl_serve, on which the
+dialed side asks and the dialer answers.  either way the connection
+stays open for the next blob, until it fails or the last sync
+connection to that peer goes.
+
+blobs are checked against their hash before we keep them.  custody only
+moves when the asker acks, see CACHE in cache.go.  a fetch that no peer
+answers within the fetch timeout fails the read or open with EIO.
+*/
+
+const (
+	fetch_missing byte = iota
+	fetch_found
+	fetch_custody
+)
+const fetch_timeout = 30 * time.Second
+
+var errNotOnPeer = errors.New("Blob not on peer")
+
+// make sure we hold blob hash, fetching it if need be
+func (f *FS) ensureBlob(hash []byte) error {
+	if f.HasBlob(hash) {
+		return nil
+	}
+
+	// one fetch per blob, everyone else waits for it
+	key := string(hash)
+	f.fetchmu.Lock()
+	wait, busy := f.fetching[key]
+	if !busy {
+		wait = make(chan struct{})
+		f.fetching[key] = wait
+	}
+	f.fetchmu.Unlock()
+
+	if busy {
+		<-wait
+	} else {
+		err := f.FetchBlob(hash)
+		if err != nil {
+			log.Println("fetch", hex.EncodeToString(hash), "failed:", err)
+		}
+		f.fetchmu.Lock()
+		delete(f.fetching, key)
+		f.fetchmu.Unlock()
+		close(wait)
+	}
+
+	if !f.HasBlob(hash) {
+		return fuse.Errno(syscall.EIO)
+	}
+	return nil
+}
+
+// a database we have sync connections with
+type peerLink struct {
+	syncs int // open sync connections
+	addr string // where we dial it, "" if it only dials us
+	fc *fetchConn // where we ask it for blobs, nil until we have one
+}
+
+// a connection we ask for blobs on
+type fetchConn struct {
+	mu sync.Mutex // one request at a time
+	conn net.Conn
+	reader *bufio.Reader
+	once sync.Once
+	dead chan struct{} // closed with the connection
+}
+
+func newFetchConn(conn net.Conn, reader *bufio.Reader) *fetchConn {
+	return &fetchConn{conn: conn, reader: reader, dead: make(chan struct{})}
+}
+
+func (fc *fetchConn) close() {
+	fc.once.Do(func() {
+		fc.conn.Close()
+		close(fc.dead)
+	})
+}
+
+// a sync connection to dbid is up.  addr is where we dialed it, if we did.
+func (f *FS) peerUp(dbid uint16, addr string) {
+	f.linkmu.Lock()
+	defer f.linkmu.Unlock()
+	l := f.links[dbid]
+	if l == nil {
+		l = &peerLink{}
+		f.links[dbid] = l
+	}
+	l.syncs++
+	if addr != "" {
+		l.addr = addr
+	}
+}
+
+func (f *FS) peerDown(dbid uint16) {
+	f.linkmu.Lock()
+	defer f.linkmu.Unlock()
+	l := f.links[dbid]
+	if l == nil {
+		return
+	}
+	l.syncs--
+	if l.syncs <= 0 && l.fc != nil {
+		l.fc.close()
+		l.fc = nil
+	}
+}
+
+// databases we have sync connections with
+func (f *FS) linkedPeers() []uint16 {
+	f.linkmu.Lock()
+	defer f.linkmu.Unlock()
+	list := []uint16{}
+	for dbid, l := range f.links {
+		if l.syncs > 0 {
+			list = append(list, dbid)
+		}
+	}
+	return list
+}
+
+// ask dbid for blobs on fc from now on
+func (f *FS) setFetchConn(dbid uint16, fc *fetchConn) {
+	f.linkmu.Lock()
+	defer f.linkmu.Unlock()
+	l := f.links[dbid]
+	if l == nil {
+		l = &peerLink{}
+		f.links[dbid] = l
+	}
+	if l.fc != nil {
+		l.fc.close()
+	}
+	l.fc = fc
+}
+
+func (f *FS) dropFetchConn(dbid uint16, fc *fetchConn) {
+	fc.close()
+	f.linkmu.Lock()
+	defer f.linkmu.Unlock()
+	if l := f.links[dbid]; l != nil && l.fc == fc {
+		l.fc = nil
+	}
+}
+
+// the connection to ask dbid for blobs on, dialing one if we can
+func (f *FS) fetchConnTo(dbid uint16, deadline time.Time) (*fetchConn, error) {
+	f.linkmu.Lock()
+	l := f.links[dbid]
+	var fc *fetchConn
+	var addr string
+	if l != nil {
+		fc = l.fc
+		addr = l.addr
+	}
+	f.linkmu.Unlock()
+	if fc != nil {
+		return fc, nil
+	}
+	if addr == "" {
+		return nil, errors.New("Peer has not offered blobs yet")
+	}
+
+	conn, err := net.DialTimeout("tcp", addr, deadline.Sub(time.Now()))
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(deadline)
+	reader := bufio.NewReader(conn)
+	err = writeHello(conn, &replHello{Purpose: repl_fetch, Dbid: f.dbid})
+	if err == nil {
+		var hello *replHello
+		hello, err = readHello(reader)
+		if err == nil && hello.Dbid != dbid {
+			err = errors.New("Peer changed its dbid")
+		}
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+
+	fc = newFetchConn(conn, reader)
+	f.linkmu.Lock()
+	defer f.linkmu.Unlock()
+	l = f.links[dbid]
+	if l == nil {
+		// the sync connection went meanwhile
+		fc.close()
+		return nil, errors.New("Peer went away")
+	}
+	if l.fc != nil {
+		// someone else dialed too
+		fc.close()
+		return l.fc, nil
+	}
+	l.fc = fc
+	return fc, nil
+}
+
+// ask every peer in turn for blob hash, giving up after the fetch timeout
+func (f *FS) FetchBlob(hash []byte) error {
+	dbids := f.linkedPeers()
+	if len(dbids) == 0 {
+		return errors.New("No peers to fetch from")
+	}
+	deadline := time.Now().Add(f.fetchTimeout)
+	err := errNotOnPeer
+	for _, dbid := range dbids {
+		if time.Now().After(deadline) {
+			return errors.New("Fetch timed out")
+		}
+		var fc *fetchConn
+		fc, err = f.fetchConnTo(dbid, deadline)
+		if err != nil {
+			log.Println("fetch from dbid", dbid, "error:", err)
+			continue
+		}
+		err = f.fetchOn(fc, hash, deadline)
+		if err == nil {
+			return nil
+		}
+		if err != errNotOnPeer {
+			// whatever state the connection is in, it's no good now
+			log.Println("fetch from dbid", dbid, "error:", err)
+			f.dropFetchConn(dbid, fc)
+		}
+	}
+	return err
+}
+
+func (f *FS) fetchOn(fc *fetchConn, hash []byte, deadline time.Time) error {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	conn := fc.conn
+	reader := fc.reader
+	conn.SetDeadline(deadline)
+	defer conn.SetDeadline(time.Time{})
+
+	// without a cap we keep everything anyway, so we may as well
+	// take custody
+	want := byte(0)
+	if f.cacheMax <= 0 {
+		want = 1
+	}
+	_, err := conn.Write(append(append([]byte{}, hash...), want))
+	if err != nil {
+		return err
+	}
+	found, err := reader.ReadByte()
+	if err != nil {
+		return err
+	}
+	if found != fetch_found && found != fetch_custody {
+		return errNotOnPeer
+	}
+	var n uint64
+	err = binary.Read(reader, binary.LittleEndian, &n)
+	if err != nil {
+		return err
+	}
+
+	got, size, err := f.storeBlob(io.LimitReader(reader, int64(n)), false)
+	if err != nil {
+		return err
+	}
+	if size != n {
+		return io.ErrUnexpectedEOF
+	}
+	if !bytes.Equal(got, hash) {
+		// whatever we stored is unreferenced, and the next gc takes it
+		if found == fetch_custody {
+			conn.Write([]byte{0})
+		}
+		return errors.New("Fetched blob does not match its hash")
+	}
+
+	err = f.setCustody(hash, found == fetch_custody)
+	if found == fetch_custody {
+		ack := byte(1)
+		if err != nil {
+			ack = 0
+		}
+		_, werr := conn.Write([]byte{ack})
+		if err == nil {
+			err = werr
+		}
+	}
+	return err
+}
+
+// offer blobs to dbid, which we dialed at addr for sync, until done
+func (f *FS) serveBack(addr string, dbid uint16, done chan struct{}) {
+	conn, err := net.DialTimeout("tcp", addr, repl_dial_timeout)
+	if err != nil {
+		log.Println("fetch serve dial error:", err)
+		return
+	}
+	go func() {
+		<-done
+		conn.Close()
+	}()
+
+	reader := bufio.NewReader(conn)
+	err = writeHello(conn, &replHello{Purpose: repl_serve, Dbid: f.dbid})
+	if err != nil {
+		log.Println("fetch serve write error:", err)
+		return
+	}
+	hello, err := readHello(reader)
+	if err != nil {
+		log.Println("fetch serve hello error:", err)
+		return
+	}
+	if hello.Dbid != dbid {
+		log.Println("fetch serve hello error: peer changed its dbid")
+		return
+	}
+	f.serveFetch(conn, reader)
+}
+
+// answer blob requests on a fetch connection until the peer hangs up
+func (f *FS) serveFetch(conn net.Conn, reader *bufio.Reader) {
+	writer := bufio.NewWriter(conn)
+	req := make([]byte, hash_len + 1)
+	for {
+		_, err := io.ReadFull(reader, req)
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			log.Println("fetch read error:", err)
+			return
+		}
+		hash := req[:hash_len]
+
+		// hand over custody only when the peer asks for it
+		answer := fetch_found
+		if req[hash_len] == 1 && f.HasCustody(hash) {
+			answer = fetch_custody
+		}
+		sent, err := f.sendBlob(writer, hash, answer)
+		if err == nil {
+			err = writer.Flush()
+		}
+		if err != nil {
+			log.Println("fetch write error:", err)
+			return
+		}
+		if !sent || answer != fetch_custody {
+			continue
+		}
+
+		ack, err := reader.ReadByte()
+		if err != nil {
+			log.Println("fetch read error:", err)
+			return
+		}
+		if ack == 1 {
+			err = f.setCustody(hash, false)
+			if err != nil {
+				log.Println("fetch custody error:", err)
+				return
+			}
+		}
+	}
+}
+
+// answer a request for hash, returns whether we had it
+func (f *FS) sendBlob(w *bufio.Writer, hash []byte, answer byte) (bool, error) {
+	fh, err := os.Open(f.BlobPath(hash))
+	if err != nil {
+		return false, w.WriteByte(fetch_missing)
+	}
+	defer fh.Close()
+	fi, err := fh.Stat()
+	if err != nil {
+		return false, w.WriteByte(fetch_missing)
+	}
+
+	w.WriteByte(answer)
+	binary.Write(w, binary.LittleEndian, uint64(fi.Size()))
+	n, err := io.Copy(w, fh)
+	if err == nil && n != fi.Size() {
+		err = io.ErrUnexpectedEOF
+	}
+	return true, err
+}
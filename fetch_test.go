@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"math/rand"
+	"net"
+	"reflect"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"bazil.org/fuse"
+)
+
+func testReadAll(t *testing.T, d Dir, name string) []byte {
+	n, err := d.Lookup(name, nil)
+	if err != nil {
+		t.Fatalf("lookup %s: %v", name, err)
+	}
+	file := n.(File)
+	h := testOpen(t, &file, syscall.O_RDONLY)
+	defer testRelease(t, h)
+	data := []byte{}
+	for {
+		got := testRead(t, h, int64(len(data)), 128 * 1024)
+		if got == "" {
+			return data
+		}
+		data = append(data, got...)
+	}
+}
+
+func testFetchConn(f *FS, dbid uint16) *fetchConn {
+	f.linkmu.Lock()
+	defer f.linkmu.Unlock()
+	if l := f.links[dbid]; l != nil {
+		return l.fc
+	}
+	return nil
+}
+
+// a only listens, b dials it.  both fetch what the other wrote over the
+// connections they already have.
+func TestFetchLinkedPeers(t *testing.T) {
+	a := testFS(t, 1)
+	b := testFS(t, 2)
+	a.fetchTimeout = 5 * time.Second
+	b.fetchTimeout = 5 * time.Second
+	ra, rb := Dir{inode: root_inode, fs: a}, Dir{inode: root_inode, fs: b}
+
+	rnd := rand.New(rand.NewSource(1))
+	da := make([]byte, 3 << 20)
+	rnd.Read(da)
+	db := make([]byte, 3 << 20)
+	rnd.Read(db)
+	testCreate(t, ra, "from-a", string(da))
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var mu sync.Mutex
+	accepted := 0
+	conns := []net.Conn{}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			accepted++
+			conns = append(conns, c)
+			mu.Unlock()
+			go a.handlePeer(c, "")
+		}
+	}()
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() { b.handlePeer(c, l.Addr().String()); close(done) }()
+	defer func() {
+		l.Close()
+		c.Close()
+		<-done
+		mu.Lock()
+		for _, c := range conns {
+			c.Close()
+		}
+		mu.Unlock()
+	}()
+
+	waitFor := func(what string, ok func() bool) {
+		deadline := time.Now().Add(5 * time.Second)
+		for !ok() {
+			if time.Now().After(deadline) {
+				t.Fatal("timed out waiting for", what)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	synced := func() bool {
+		return reflect.DeepEqual(testMarks(t, a), testMarks(t, b))
+	}
+	waitFor("sync", synced)
+
+	if got := testReadAll(t, rb, "from-a"); !bytes.Equal(got, da) {
+		t.Fatalf("dialer read %d bytes, not what was written", len(got))
+	}
+
+	testCreate(t, rb, "from-b", string(db))
+	waitFor("sync", synced)
+	waitFor("the dialer to offer blobs", func() bool { return testFetchConn(a, 2) != nil })
+	if got := testReadAll(t, ra, "from-b"); !bytes.Equal(got, db) {
+		t.Fatalf("listener read %d bytes, not what was written", len(got))
+	}
+	if got := testReadAll(t, ra, "from-b"); !bytes.Equal(got, db) {
+		t.Fatalf("listener read %d bytes again, not what was written", len(got))
+	}
+
+	// sync, the blobs b serves, the blobs b asks for
+	mu.Lock()
+	n := accepted
+	mu.Unlock()
+	if n != 3 {
+		t.Errorf("%d connections for two files, want 3", n)
+	}
+
+	a.fetchTimeout = time.Second
+	if err := a.ensureBlob(bytes.Repeat([]byte{1}, hash_len)); err != fuse.Errno(syscall.EIO) {
+		t.Errorf("blob nobody has: %v, want EIO", err)
+	}
+	if testFetchConn(a, 2) == nil {
+		t.Error("a blob the peer doesn't have dropped the connection")
+	}
+}
+
+func TestFetchNoPeers(t *testing.T) {
+	a := testFS(t, 1)
+	a.fetchTimeout = time.Second
+	if err := a.ensureBlob(bytes.Repeat([]byte{1}, hash_len)); err != fuse.Errno(syscall.EIO) {
+		t.Errorf("no peers: %v, want EIO", err)
+	}
+}
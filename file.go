@@ -4,10 +4,11 @@ import (
 	"bazil.org/fuse"
 	"bazil.org/fuse/fs"
 	"github.com/boltdb/bolt"
+	"bytes"
 	"errors"
 	"log"
-	"strconv"
 	"syscall"
+	"time"
 )
 
 var _ = log.Println
@@ -20,24 +21,56 @@ type File struct {
 func (f File) Attr() fuse.Attr {
 	//log.Println(f.inode, "fattr")
 
-	fpath := f.fs.storagepath + "/files/" + strconv.FormatUint(f.inode, 10)
-
 	attr := fuse.Attr{
 		Inode: f.inode,
 		Mode: 0644,
 		Nlink: 1,
+		Size: f.LoadSize(),
+	}
+
+	fpath, writing, err := f.fs.statPath(f.inode)
+	if err != nil {
+		return attr
 	}
 
 	stat := syscall.Stat_t{}
-	err := syscall.Stat(fpath, &stat)
+	err = syscall.Stat(fpath, &stat)
 	if err == nil {
 		//log.Printf("%+v\n", stat)
 		bazil_attr_from_stat_t(&stat, &attr) // see platform specific file_attr_*.go
 	}
+	if !writing {
+		// that was the manifest
+		attr.Size = f.LoadSize()
+		attr.Blocks = (attr.Size + 511) / 512
+	}
+	f.fs.db.View(func(tx *bolt.Tx) error {
+		a, err := load_attr(tx, f.inode)
+		if err != nil {
+			return err
+		}
+		if writing {
+			// unsealed writes are newer than the record
+			a.Mtime, a.Ctime = 0, 0
+		}
+		a.fill(&attr)
+		n, err := f.fs.Nlink(tx, f.inode)
+		attr.Nlink = uint32(n)
+		return err
+	})
 
 	return attr
 }
 
+func (f File) Setattr(req *fuse.SetattrRequest, resp *fuse.SetattrResponse, intr fs.Intr) fuse.Error {
+	err := f.fs.Setattr(f.inode, req)
+	if err != nil {
+		return err
+	}
+	resp.Attr = f.Attr()
+	return nil
+}
+
 func (f File) Fsync(req *fuse.FsyncRequest, intr fs.Intr) fuse.Error {
 	//log.Println(f.inode, "sync")
 
@@ -56,6 +89,13 @@ func (f File) Listxattr(req *fuse.ListxattrRequest, resp *fuse.ListxattrResponse
 		if xtb == nil {
 			return errors.New("Missing xattrs bucket")
 		}
+		pinned, err := f.fs.IsPinned(tx, f.inode)
+		if err != nil {
+			return err
+		}
+		if pinned {
+			resp.Append(pin_xattr)
+		}
 		key := uint64_b(f.inode)
 		xb := xtb.Bucket(key)
 		if xb == nil {
@@ -70,8 +110,16 @@ func (f File) Listxattr(req *fuse.ListxattrRequest, resp *fuse.ListxattrResponse
 	})
 }
 
+
 func (f File) Getxattr(req *fuse.GetxattrRequest, resp *fuse.GetxattrResponse, intr fs.Intr) fuse.Error {
 	return f.fs.db.View(func(tx *bolt.Tx) error {
+		if req.Name == pin_xattr {
+			pinned, err := f.fs.IsPinned(tx, f.inode)
+			if pinned {
+				resp.Xattr = []byte("1")
+			}
+			return err
+		}
 		xtb := tx.Bucket([]byte("xattrs"))
 		if xtb == nil {
 			return errors.New("Missing xattrs bucket")
@@ -88,6 +136,10 @@ func (f File) Getxattr(req *fuse.GetxattrRequest, resp *fuse.GetxattrResponse, i
 }
 
 func (f File) Setxattr(req *fuse.SetxattrRequest, intr fs.Intr) fuse.Error {
+	if req.Name == pin_xattr {
+		// local only, see PINS
+		return f.fs.SetPin(f.inode, true)
+	}
 	return f.fs.db.Update(func(tx *bolt.Tx) error {
 		xtb := tx.Bucket([]byte("xattrs"))
 		if xtb == nil {
@@ -98,11 +150,20 @@ func (f File) Setxattr(req *fuse.SetxattrRequest, intr fs.Intr) fuse.Error {
 		if err != nil {
 			return err
 		}
-		return xb.Put([]byte(req.Name), req.Xattr)
+		name := []byte(req.Name)
+		err = xb.Put(name, req.Xattr)
+		if err != nil {
+			return err
+		}
+		_, err = f.fs.NewTx(tx, TX_SETXATTR, f.inode, name, 0, req.Xattr, f.inode)
+		return err
 	})
 }
 
 func (f File) Removexattr(req *fuse.RemovexattrRequest, intr fs.Intr) fuse.Error {
+	if req.Name == pin_xattr {
+		return f.fs.SetPin(f.inode, false)
+	}
 	return f.fs.db.Update(func(tx *bolt.Tx) error {
 		xtb := tx.Bucket([]byte("xattrs"))
 		if xtb == nil {
@@ -113,23 +174,27 @@ func (f File) Removexattr(req *fuse.RemovexattrRequest, intr fs.Intr) fuse.Error
 		if xb == nil {
 			return nil
 		}
-		return xb.Delete([]byte(req.Name))
+		name := []byte(req.Name)
+		if xb.Get(name) == nil {
+			return nil
+		}
+		err := xb.Delete(name)
+		if err != nil {
+			return err
+		}
+		_, err = f.fs.NewTx(tx, TX_RMXATTR, f.inode, name, 0, nil, f.inode)
+		return err
 	})
 }
 
 func (f File) LoadSize() uint64 {
 	var fsize uint64
 	f.fs.db.View(func(tx *bolt.Tx) error {
-		fsizes := tx.Bucket([]byte("filesize"))
-		if fsizes == nil {
-			return errors.New("Missing filesize bucket")
-		}
-		key := uint64_b(f.inode)
-		val := fsizes.Get(key)
-		if val == nil {
-			return errors.New("Filesize missing")
+		r, err := load_inode(tx, f.inode)
+		if err != nil || r == nil {
+			return err
 		}
-		fsize = b_uint64(val)
+		fsize = r.Size
 		return nil
 	})
 	return fsize
@@ -140,21 +205,42 @@ func (f File) Open(req *fuse.OpenRequest, resp *fuse.OpenResponse, intr fs.Intr)
 	return NewHandle(&f, req.Flags)
 }
 
-func (f File) SaveSize(size uint64) error {
-
-	err := f.fs.db.Update(func(tx *bolt.Tx) error {
-		fsizes := tx.Bucket([]byte("filesize"))
-		if fsizes == nil {
-			return errors.New("Missing filesize bucket")
-		}
-		key := uint64_b(f.inode)
-		val := fsizes.Get(key)
-		if val == nil {
-			return errors.New("File size key missing, cannot update")
-		}
-		val = uint64_b(size)
-		return fsizes.Put(key, val)
+func (f File) SaveContent(ref []byte, size uint64) error {
+	return f.fs.db.Update(func(tx *bolt.Tx) error {
+		return f.saveContent(tx, ref, size)
 	})
+}
+
+// make ref the content, inside a bolt transaction
+func (f File) saveContent(tx *bolt.Tx, ref []byte, size uint64) error {
+	r, err := load_inode(tx, f.inode)
+	if err != nil {
+		return err
+	}
+	if r == nil || r.Type != inode_file {
+		return errors.New("File record missing, cannot update")
+	}
+	old, err := content_ref(tx, f.inode)
+	if err != nil {
+		return err
+	}
+	if bytes.Equal(old, ref) && r.Size == size {
+		return nil
+	}
+	orphan, err := f.fs.IsOrphan(tx, f.inode)
+	if err != nil || orphan {
+		// unlinked, only its handles still care
+		return err
+	}
 
+	r.Size = size
+	r.Content = ref
+	r.Attr.Mtime = time.Now().UnixNano()
+	r.Attr.Ctime = r.Attr.Mtime
+	err = save_inode(tx, f.inode, r)
+	if err != nil {
+		return err
+	}
+	_, err = f.fs.NewTx(tx, TX_SETCONTENT, f.inode, ref, size, nil, f.inode)
 	return err
 }
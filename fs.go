@@ -12,6 +12,7 @@ import (
 	"bazil.org/fuse/fs"
 	"fmt"
 	"strconv"
+	"time"
 )
 
 var _ = log.Println
@@ -20,7 +21,8 @@ const root_inode uint64 = 1
 const min_inode uint64 = 10
 
 const max_name_len = 4096
-const max_txn_size = max_name_len*2 + 256
+const max_xattr_len = 65535 // must fit a TxNameLen
+const max_txn_size = max_name_len + max_xattr_len + 256
 
 
 type FS struct {
@@ -30,6 +32,27 @@ type FS struct {
 	generation uint64
 	dbid uint16
 	txid uint64
+
+	txsigmu sync.Mutex
+	txsig chan struct{}
+
+	openmu sync.Mutex
+	staged map[uint64]string // inode -> staging copy last written
+	handles map[uint64]int // inode -> open handles, see LINKS
+	writers map[uint64][]*Handle // inode -> handles open for writing
+	readers map[*contentReader]bool // open sealed content, see GC
+
+	linkmu sync.Mutex
+	links map[uint16]*peerLink // dbid -> how we reach it, see FETCHING
+	fetchTimeout time.Duration
+	fetchmu sync.Mutex
+	fetching map[string]chan struct{} // blob hash -> closed when fetched
+
+	cacheMax int64 // bytes, 0 for no cap
+	usemu sync.Mutex
+	blobuse map[string]int64 // blob hash -> last read, see CACHE
+
+	prefetchkick chan struct{}
 }
 
 func newfs(stoarage string) (*FS, error) {
@@ -38,29 +61,7 @@ func newfs(stoarage string) (*FS, error) {
 		return nil, err
 	}
 
-	err = db.Update(func(tx *bolt.Tx) error {
-		if _, err := tx.CreateBucketIfNotExists([]byte("misc")); err != nil {
-			return err
-		}
-		if _, err := tx.CreateBucketIfNotExists([]byte("filesize")); err != nil {
-			return err
-		}
-		if _, err := tx.CreateBucketIfNotExists([]byte("xattrs")); err != nil {
-			return err
-		}
-		if _, err := tx.CreateBucketIfNotExists([]byte("tx")); err != nil {
-			return err
-		}
-		cb, err := tx.CreateBucketIfNotExists([]byte("kids"))
-		if err != nil {
-			return err
-		}
-		if _, err := cb.CreateBucketIfNotExists(uint64_b(root_inode)); err != nil {
-			return err
-		}
-
-		return nil
-	})
+	err = upgrade(db, stoarage + "/fs.bolt")
 	if err != nil {
 		db.Close()
 		return nil, err
@@ -69,6 +70,21 @@ func newfs(stoarage string) (*FS, error) {
 	fs := FS{
 		storagepath: stoarage,
 		db: db,
+		staged: map[uint64]string{},
+		handles: map[uint64]int{},
+		writers: map[uint64][]*Handle{},
+		readers: map[*contentReader]bool{},
+		links: map[uint16]*peerLink{},
+		fetchTimeout: fetch_timeout,
+		fetching: map[string]chan struct{}{},
+		blobuse: map[string]int64{},
+		prefetchkick: make(chan struct{}, 1),
+	}
+
+	err = fs.initBlobs()
+	if err != nil {
+		db.Close()
+		return nil, err
 	}
 
 	return &fs, nil
@@ -78,7 +94,19 @@ func (fs *FS) CloseBolt() {
 	fs.db.Close()
 }
 
+// a fresh inode for an object we are creating
 func (fs *FS) NewInode(tx *bolt.Tx) (uint64, error) {
+	if fs.dbid == 0 {
+		return 0, errors.New("Database ID not set")
+	}
+	r, err := fs.nextInode(tx)
+	if err != nil {
+		return 0, err
+	}
+	return r, fs.setOid(tx, r, make_oid(fs.dbid, r))
+}
+
+func (fs *FS) nextInode(tx *bolt.Tx) (uint64, error) {
 	b := tx.Bucket([]byte("misc"))
 	if b == nil {
 		return 0, errors.New("Misc bucket not found")
@@ -88,6 +116,9 @@ func (fs *FS) NewInode(tx *bolt.Tx) (uint64, error) {
 		r = min_inode
 	}
 	r++
+	if r > oid_inode_mask {
+		return 0, errors.New("Out of inodes")
+	}
 	err := b.Put([]byte("lastinode"), uint64_b(r))
 	if err != nil {
 		return 0, err
@@ -195,6 +226,15 @@ func uint64_b(i uint64) []byte {
 	binary.Write(&buf, binary.LittleEndian, i)
 	return buf.Bytes()
 }
+func b_uint16(b []byte) uint16 {
+	if(len(b) != 2) {
+		return 0
+	}
+	var i uint16
+	buf := bytes.NewReader(b)
+	binary.Read(buf, binary.LittleEndian, &i)
+	return i
+}
 func b_uint64(b []byte) uint64 {
 	if(len(b) != 8) {
 		return 0
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"net"
+	"os"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"github.com/boltdb/bolt"
+)
+
+// a fresh filesystem in a temporary directory, set up like main does
+func testFS(t *testing.T, dbid uint16) *FS {
+	storage := t.TempDir()
+	err := os.Mkdir(storage + "/files", 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := newfs(storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.dbid = dbid
+	t.Cleanup(f.CloseBolt)
+	return f
+}
+
+func testMarks(t *testing.T, f *FS) map[uint16]uint64 {
+	var marks map[uint16]uint64
+	err := f.db.View(func(tx *bolt.Tx) error {
+		var err error
+		marks, err = f.TxMarks(tx)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return marks
+}
+
+// connect a and b the way replication peers do.  returns the hangup.
+func testConnect(t *testing.T, a, b *FS) func() {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	cb, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan struct{}, 2)
+	go func() { a.handlePeer(ca, ""); done <- struct{}{} }()
+	go func() { b.handlePeer(cb, ""); done <- struct{}{} }()
+	return func() {
+		ca.Close()
+		cb.Close()
+		<-done
+		<-done
+	}
+}
+
+// wait until a and b hold the same log
+func testSynced(t *testing.T, a, b *FS) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !reflect.DeepEqual(testMarks(t, a), testMarks(t, b)) {
+		if time.Now().After(deadline) {
+			t.Fatalf("no sync: %v vs %v", testMarks(t, a), testMarks(t, b))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// connect a and b, wait until each has the other's log, and hang up again
+func testSync(t *testing.T, a, b *FS) {
+	hangup := testConnect(t, a, b)
+	defer hangup()
+	testSynced(t, a, b)
+}
+
+// what d shows, sorted
+func testNames(t *testing.T, d Dir) []string {
+	ents, err := d.ReadDir(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := []string{}
+	for _, e := range ents {
+		names = append(names, e.Name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func checkNames(t *testing.T, who string, d Dir, want ...string) {
+	if want == nil {
+		want = []string{}
+	}
+	if got := testNames(t, d); !reflect.DeepEqual(got, want) {
+		t.Errorf("%s shows %v, want %v", who, got, want)
+	}
+}
+
+func testLookupDir(t *testing.T, d Dir, name string) Dir {
+	n, err := d.Lookup(name, nil)
+	if err != nil {
+		t.Fatalf("lookup %s: %v", name, err)
+	}
+	sub, ok := n.(Dir)
+	if !ok {
+		t.Fatalf("%s is not a directory", name)
+	}
+	return sub
+}
+
+func testMkdir(t *testing.T, d Dir, name string) Dir {
+	n, err := d.Mkdir(&fuse.MkdirRequest{Name: name, Mode: 0755}, nil)
+	if err != nil {
+		t.Fatalf("mkdir %s: %v", name, err)
+	}
+	return *n.(*Dir)
+}
+
+func testRmdir(t *testing.T, d Dir, name string) {
+	err := d.Remove(&fuse.RemoveRequest{Name: name, Dir: true}, nil)
+	if err != nil {
+		t.Fatalf("rmdir %s: %v", name, err)
+	}
+}
+
+func testRename(d Dir, old string, nd fs.Node, name string) error {
+	return d.Rename(&fuse.RenameRequest{OldName: old, NewName: name}, nd, nil)
+}
@@ -0,0 +1,365 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/boltdb/bolt"
+	"io/ioutil"
+	"log"
+	"os"
+	"time"
+)
+
+/* GC
+
+removing the last name of an inode reclaims it, see LINKS, but
+databases from before that leaked them.  gc reclaims orphans nobody has
+open, then marks every inode reachable from the root through "kids",
+zombies and aliases included, and deletes whatever inode_buckets and
+oids/oidx hold for any other inode that isn't open or an orphan.
+
+then it marks every blob the remaining content references, manifests and
+their chunks, plus the content of our own TX_SETCONTENTs that no peer
+has yet and the chunks open handles still read from since before an
+overwrite, and deletes the other blobs.  manifests we don't have are
+fetched first, since their chunks may be ours to keep; if one can't be,
+blobs in our custody stay this time.  blobs younger than gc_grace may be
+about to be referenced by content being sealed, and stay too.  there
+are no snapshots yet, so nothing else refers to content.
+
+"peermarks": peer dbid -> the last of our transactions it had (u64), as
+	of its last hello
+*/
+
+const gc_grace = 10 * time.Minute
+
+type gcStats struct {
+	inodes int
+	blobs int
+	bytes int64
+}
+
+func (s gcStats) String() string {
+	return fmt.Sprintf("%d inodes, %d blobs, %d bytes", s.inodes, s.blobs, s.bytes)
+}
+
+// remember what a peer had of ours when it said hello
+func (f *FS) savePeerMark(dbid uint16, txid uint64) error {
+	return f.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("peermarks"))
+		if b == nil {
+			return errors.New("Missing peermarks bucket")
+		}
+		if old := b.Get(uint16_b(dbid)); old != nil && b_uint64(old) >= txid {
+			return nil
+		}
+		return b.Put(uint16_b(dbid), uint64_b(txid))
+	})
+}
+
+// the last of our transactions some peer is known to have
+func (f *FS) replicatedMark(tx *bolt.Tx) (uint64, error) {
+	b := tx.Bucket([]byte("peermarks"))
+	if b == nil {
+		return 0, errors.New("Missing peermarks bucket")
+	}
+	var mark uint64
+	err := b.ForEach(func(k, v []byte) error {
+		if b_uint64(v) > mark {
+			mark = b_uint64(v)
+		}
+		return nil
+	})
+	return mark, err
+}
+
+// every inode reachable from the root
+func (f *FS) liveInodes(tx *bolt.Tx) (map[uint64]bool, error) {
+	list, err := f.subtree(tx, root_inode)
+	if err != nil {
+		return nil, err
+	}
+	live := make(map[uint64]bool, len(list))
+	for _, inode := range list {
+		live[inode] = true
+	}
+	return live, nil
+}
+
+// delete the keys of b that are dead inodes, nested buckets included
+func gc_inode_keys(b *bolt.Bucket, live map[uint64]bool) (map[uint64]bool, error) {
+	dead := [][]byte{}
+	c := b.Cursor()
+	for k, _ := c.First(); k != nil; k, _ = c.Next() {
+		if len(k) == 8 && !live[b_uint64(k)] {
+			dead = append(dead, append([]byte{}, k...))
+		}
+	}
+	gone := map[uint64]bool{}
+	for _, k := range dead {
+		var err error
+		if b.Bucket(k) != nil {
+			err = b.DeleteBucket(k)
+		} else {
+			err = b.Delete(k)
+		}
+		if err != nil {
+			return nil, err
+		}
+		gone[b_uint64(k)] = true
+	}
+	return gone, nil
+}
+
+// drop metadata of unreachable inodes, returns how many there were
+func (f *FS) gcInodes() (int, error) {
+	err := f.ReclaimOrphans()
+	if err != nil {
+		return 0, err
+	}
+
+	f.openmu.Lock()
+	open := map[uint64]bool{}
+	for inode := range f.handles {
+		open[inode] = true
+	}
+	f.openmu.Unlock()
+
+	count := 0
+	err = f.db.Update(func(tx *bolt.Tx) error {
+		live, err := f.liveInodes(tx)
+		if err != nil {
+			return err
+		}
+		for inode := range open {
+			live[inode] = true
+		}
+		orphans := tx.Bucket([]byte("orphans"))
+		if orphans == nil {
+			return errors.New("Missing orphans bucket")
+		}
+		orphans.ForEach(func(k, v []byte) error {
+			live[b_uint64(k)] = true
+			return nil
+		})
+
+		gone := map[uint64]bool{}
+		for _, name := range inode_buckets {
+			b := tx.Bucket([]byte(name))
+			if b == nil {
+				return errors.New("Missing " + name + " bucket")
+			}
+			g, err := gc_inode_keys(b, live)
+			if err != nil {
+				return err
+			}
+			for inode := range g {
+				gone[inode] = true
+			}
+		}
+
+		oids := tx.Bucket([]byte("oids"))
+		if oids == nil {
+			return errors.New("Missing oids bucket")
+		}
+		oidx := tx.Bucket([]byte("oidx"))
+		if oidx == nil {
+			return errors.New("Missing oidx bucket")
+		}
+		dead := [][2][]byte{}
+		oids.ForEach(func(k, v []byte) error {
+			if !live[b_uint64(k)] {
+				dead = append(dead, [2][]byte{append([]byte{}, k...), append([]byte{}, v...)})
+			}
+			return nil
+		})
+		for _, d := range dead {
+			if err := oids.Delete(d[0]); err != nil {
+				return err
+			}
+			if v := oidx.Get(d[1]); v != nil && b_uint64(v) == b_uint64(d[0]) {
+				if err := oidx.Delete(d[1]); err != nil {
+					return err
+				}
+			}
+			gone[b_uint64(d[0])] = true
+		}
+
+		count = len(gone)
+		return nil
+	})
+	return count, err
+}
+
+// content references to keep blobs for
+func (f *FS) liveContent() ([][]byte, error) {
+	refs := [][]byte{}
+	err := f.db.View(func(tx *bolt.Tx) error {
+		ib, err := inodes_index(tx)
+		if err != nil {
+			return err
+		}
+		err = ib.ForEach(func(k, v []byte) error {
+			r, err := InodeRecordFromBytes(v)
+			if err != nil {
+				return err
+			}
+			if len(r.Content) != 0 {
+				refs = append(refs, r.Content)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		// ours that no peer has seen yet may still be fetched
+		mark, err := f.replicatedMark(tx)
+		if err != nil {
+			return err
+		}
+		b := tx.Bucket([]byte("tx"))
+		if b == nil {
+			return errors.New("Missing tx bucket")
+		}
+		c := b.Cursor()
+		for k, v := c.Seek(tx_key(f.dbid, mark + 1)); k != nil; k, v = c.Next() {
+			if len(k) != 10 || binary.BigEndian.Uint16(k) != f.dbid {
+				break
+			}
+			txn, err := TxFromKV(k, v)
+			if err != nil {
+				return err
+			}
+			if txn.Op == TX_SETCONTENT && len(txn.Name) != 0 {
+				refs = append(refs, txn.Name)
+			}
+		}
+		return nil
+	})
+	return refs, err
+}
+
+// chunks of content some handle has open
+func (f *FS) openChunks() [][]byte {
+	f.openmu.Lock()
+	defer f.openmu.Unlock()
+	hashes := [][]byte{}
+	for cr := range f.readers {
+		for _, c := range cr.chunks {
+			hashes = append(hashes, c.hash)
+		}
+	}
+	return hashes
+}
+
+// delete blobs nothing refers to
+func (f *FS) gcBlobs() (int, int64, error) {
+	start := time.Now()
+	refs, err := f.liveContent()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	marked := map[string]bool{string(empty_hash): true}
+	for _, hash := range f.openChunks() {
+		marked[string(hash)] = true
+	}
+	keepCustody := false
+	for _, ref := range refs {
+		kind, hash, err := content_ref_split(ref)
+		if err != nil {
+			continue
+		}
+		marked[string(hash)] = true
+		if kind != content_manifest {
+			continue
+		}
+		chunks, err := f.chunksOf(ref)
+		if err != nil {
+			log.Println("gc can't read manifest, keeping blobs in our custody:", err)
+			keepCustody = true
+			continue
+		}
+		for _, c := range chunks {
+			marked[string(c.hash)] = true
+		}
+	}
+
+	list, err := ioutil.ReadDir(f.blobDir())
+	if err != nil {
+		return 0, 0, err
+	}
+	count := 0
+	var freed int64
+	for _, fi := range list {
+		hash, err := hex_hash(fi.Name())
+		if err != nil || marked[string(hash)] {
+			// temporaries and anything else we don't know
+			continue
+		}
+		if fi.ModTime().After(start.Add(-gc_grace)) {
+			continue
+		}
+		if keepCustody && f.HasCustody(hash) {
+			continue
+		}
+		err = os.Remove(f.BlobPath(hash))
+		if err != nil {
+			return count, freed, err
+		}
+		count++
+		freed += fi.Size()
+	}
+
+	// forget cache entries of blobs that are gone
+	err = f.db.Update(func(tx *bolt.Tx) error {
+		bc, err := blobcache_index(tx)
+		if err != nil {
+			return err
+		}
+		dead := [][]byte{}
+		bc.ForEach(func(k, v []byte) error {
+			if !f.HasBlob(k) {
+				dead = append(dead, append([]byte{}, k...))
+			}
+			return nil
+		})
+		for _, k := range dead {
+			if err := bc.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return count, freed, err
+}
+
+func (f *FS) GC() (gcStats, error) {
+	stats := gcStats{}
+	var err error
+	stats.inodes, err = f.gcInodes()
+	if err != nil {
+		return stats, err
+	}
+	stats.blobs, stats.bytes, err = f.gcBlobs()
+	return stats, err
+}
+
+func (f *FS) SpawnGC(every time.Duration) {
+	if every <= 0 {
+		return
+	}
+	go func() {
+		for {
+			time.Sleep(every)
+			stats, err := f.GC()
+			if err != nil {
+				log.Println("gc error:", err)
+			} else {
+				log.Println("gc freed", stats)
+			}
+		}
+	}()
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// as if every blob was stored before gc_grace
+func testAgeBlobs(t *testing.T, f *FS) {
+	list, err := ioutil.ReadDir(f.blobDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-2 * gc_grace)
+	for _, fi := range list {
+		if err := os.Chtimes(f.blobDir() + "/" + fi.Name(), old, old); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// a reader keeps what it opened across an overwrite and a gc
+func TestGCOpenReader(t *testing.T) {
+	f := testFS(t, 1)
+	root := Dir{inode: root_inode, fs: f}
+	file := testCreate(t, root, "f", "old content")
+	old, err := f.ContentRef(file.inode)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rd := testOpen(t, file, syscall.O_RDONLY)
+
+	w := testOpen(t, file, syscall.O_RDWR | syscall.O_TRUNC)
+	testWrite(t, w, 0, "new content")
+	testRelease(t, w)
+	testAgeBlobs(t, f)
+	if _, err := f.GC(); err != nil {
+		t.Fatal(err)
+	}
+	if got := testRead(t, rd, 0, 100); got != "old content" {
+		t.Errorf("open reader reads %q after gc", got)
+	}
+
+	// and a peer has everything we logged
+	testRelease(t, rd)
+	if err := f.savePeerMark(2, 1 << 40); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.GC(); err != nil {
+		t.Fatal(err)
+	}
+	_, hash, err := content_ref_split(old)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.HasBlob(hash) {
+		t.Error("old content kept once nobody reads it")
+	}
+	if got := testContent(t, file); got != "new content" {
+		t.Errorf("content %q", got)
+	}
+}
@@ -6,7 +6,6 @@ import (
 //	"github.com/boltdb/bolt"
 	"os"
 	"io"
-	"strconv"
 	"log"
 	"sync"
 	"syscall"
@@ -18,10 +17,18 @@ var _ = strings.Trim
 
 type Handle struct {
 	file *File
-	fh *os.File
+	fh *os.File // private staging copy, writers only
+	rd contentFile
 	oflags fuse.OpenFlags
+	writable bool
 	id int
 	lastoffset int64
+
+	mu sync.Mutex
+	dirty bool // written since last sealed
+	stale bool // truncated under a clean copy, reload before use
+	kid fuse.HandleID // what the kernel calls us, once named
+	named bool
 }
 
 var hid int
@@ -35,50 +42,130 @@ func newhid() int {
 }
 
 func NewHandle(file *File, oflags fuse.OpenFlags) (*Handle, error) {
-	fpath := file.fs.storagepath + "/files/" + strconv.FormatUint(file.inode, 10)
-
 	h := Handle{
 		file: file,
 		oflags: oflags,
+		writable: int(oflags) & syscall.O_ACCMODE != syscall.O_RDONLY,
 		id: newhid(),
 		lastoffset: 0,
 	}
 
+	if !h.writable {
+		ref, err := file.fs.ContentRef(file.inode)
+		if err != nil {
+			return nil, err
+		}
+		h.rd, err = file.fs.OpenContent(ref)
+		if err != nil {
+			return nil, err
+		}
+		file.fs.openHandle(file.inode)
+		return &h, nil
+	}
+
+	trunc := int(oflags) & syscall.O_TRUNC != 0
 	var err error
-	h.fh, err = os.OpenFile(fpath, int(oflags), 0600)
+	h.fh, err = file.fs.newStaging(file.inode, trunc)
 	if err != nil {
 		return nil, err
 	}
+	h.rd = h.fh
+	if trunc {
+		// truncating changes the content even if nothing gets written
+		h.dirty = true
+		err = h.seal()
+		if err != nil {
+			h.fh.Close()
+			os.Remove(h.fh.Name())
+			return nil, err
+		}
+	}
 
 	//log.Println(h.file.inode, "handle", h.id, "oflags", oflags)
 
+	file.fs.openHandle(file.inode)
+	file.fs.addWriter(&h)
 	return &h, nil
 }
 
-func (h *Handle) Flush(req *fuse.FlushRequest, intr fs.Intr) fuse.Error {
-	//log.Println(h.file.inode, "handle", h.id, "flush")
-	err := h.fh.Sync()
+// a handle on a file just created, with the staging copy made for it
+// before the file was committed
+func newCreatedHandle(file *File, oflags fuse.OpenFlags, fh *os.File) *Handle {
+	h := Handle{
+		file: file,
+		fh: fh,
+		rd: fh,
+		oflags: oflags,
+		writable: int(oflags) & syscall.O_ACCMODE != syscall.O_RDONLY,
+		id: newhid(),
+	}
+	file.fs.openHandle(file.inode)
+	file.fs.addWriter(&h)
+	return &h
+}
+
+// swap in a fresh staging copy if the content was truncated under a
+// clean one.  call with h.mu held.
+func (h *Handle) reload() error {
+	if !h.stale {
+		return nil
+	}
+	fh, err := h.file.fs.newStaging(h.file.inode, false)
 	if err != nil {
 		return err
 	}
+	h.fh.Close()
+	os.Remove(h.fh.Name())
+	h.fh, h.rd = fh, fh
+	h.lastoffset = 0
+	h.stale = false
+	return nil
+}
 
-	if h.oflags & syscall.O_RDONLY == 0 {
-		stat, err := h.fh.Stat()
-		if err != nil {
-			return err
-		}
+// ftruncate through h cuts its own copy, sealed along with its writes
+func (h *Handle) truncate(size uint64) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	err := h.reload()
+	if err != nil {
+		return err
+	}
+	err = h.fh.Truncate(int64(size))
+	if err != nil {
+		return err
+	}
+	h.dirty = true
+	h.file.fs.setStaged(h.file.inode, h.fh.Name())
+	return nil
+}
 
-		s := uint64(stat.Size())
-		old := h.file.LoadSize()
+func (h *Handle) Flush(req *fuse.FlushRequest, intr fs.Intr) fuse.Error {
+	//log.Println(h.file.inode, "handle", h.id, "flush")
+	if !h.writable {
+		return nil
+	}
+	return h.seal()
+}
 
-		if s != old {
-			//log.Println(h.file.inode, "handle", h.id, "resize", s, "from", old)
+// commit the staging copy as the file's content, if it changed
+func (h *Handle) seal() error {
+	h.mu.Lock()
+	dirty := h.dirty
+	h.dirty = false
+	h.mu.Unlock()
+	if !dirty {
+		return nil
+	}
 
-			err = h.file.SaveSize(s)
-			if err != nil {
-				return err
-			}
-		}
+	err := h.fh.Sync()
+	if err == nil {
+		err = h.file.fs.SealStaging(h.file.inode, h.fh.Name())
+	}
+	if err != nil {
+		h.mu.Lock()
+		h.dirty = true
+		h.mu.Unlock()
+		return err
 	}
 	return nil
 }
@@ -88,11 +175,18 @@ func (h *Handle) Read(req *fuse.ReadRequest, resp *fuse.ReadResponse, intr fs.In
 	var err error
 	buf := resp.Data[:req.Size]
 
-	if req.Offset == h.lastoffset {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	err = h.reload()
+	if err != nil {
+		return err
+	}
+
+	if req.Offset == h.lastoffset && h.fh != nil {
 		n, err = h.fh.Read(buf)
 		h.lastoffset += int64(n)
 	} else {
-		n, err = h.fh.ReadAt(buf, req.Offset)
+		n, err = h.rd.ReadAt(buf, req.Offset)
 	}
 
 	resp.Data = buf[:n]
@@ -107,8 +201,23 @@ func (h *Handle) Read(req *fuse.ReadRequest, resp *fuse.ReadResponse, intr fs.In
 }
 
 func (h *Handle) Write(req *fuse.WriteRequest, resp *fuse.WriteResponse, intr fs.Intr) fuse.Error {
+	if !h.writable {
+		return fuse.Errno(syscall.EBADF)
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	err := h.reload()
+	if err != nil {
+		return err
+	}
+	// a writer has its id by the time its copy differs, see Setattr
+	h.kid, h.named = req.Handle, true
 	n, err := h.fh.WriteAt(req.Data, req.Offset)
 	resp.Size = n
+	if n > 0 {
+		h.dirty = true
+		h.file.fs.setStaged(h.file.inode, h.fh.Name())
+	}
 
 	//dn := n
 	//if dn > 30 {
@@ -122,29 +231,28 @@ func (h *Handle) Write(req *fuse.WriteRequest, resp *fuse.WriteResponse, intr fs
 func (h *Handle) Release(req *fuse.ReleaseRequest, intr fs.Intr) fuse.Error {
 	//log.Println(h.file.inode, "handle", h.id, "released")
 
-	if h.fh != nil {
-		if h.oflags & syscall.O_RDONLY == 0 {
-			stat, err := h.fh.Stat()
-			if err != nil {
-				h.fh.Close()
-				return err
-			}
-
-			s := uint64(stat.Size())
-			old := h.file.LoadSize()
-
-			if s != old {
-				//log.Println(h.file.inode, "handle", h.id, "resize", s, "from", old)
-
-				err = h.file.SaveSize(s)
-				if err != nil {
-					h.fh.Close()
-					return err
-				}
-			}
+	if h.rd == nil {
+		return nil
+	}
+	if h.fh == nil {
+		err := h.rd.Close()
+		if cerr := h.file.fs.closeHandle(h.file.inode); err == nil {
+			err = cerr
 		}
+		return err
+	}
 
-		return h.fh.Close()
+	err := h.seal()
+	h.file.fs.dropWriter(h)
+	h.file.fs.dropStaged(h.file.inode, h.fh.Name())
+	if cerr := h.fh.Close(); err == nil {
+		err = cerr
 	}
-	return nil
+	if rerr := os.Remove(h.fh.Name()); err == nil {
+		err = rerr
+	}
+	if cerr := h.file.fs.closeHandle(h.file.inode); err == nil {
+		err = cerr
+	}
+	return err
 }
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"syscall"
+	"testing"
+
+	"bazil.org/fuse"
+)
+
+// a file called name in d holding data
+func testCreate(t *testing.T, d Dir, name string, data string) *File {
+	n, h, err := d.Create(&fuse.CreateRequest{Name: name, Flags: fuse.OpenFlags(syscall.O_RDWR | syscall.O_CREAT), Mode: 0644}, &fuse.CreateResponse{}, nil)
+	if err != nil {
+		t.Fatalf("create %s: %v", name, err)
+	}
+	testWrite(t, h.(*Handle), 0, data)
+	err = h.(*Handle).Release(&fuse.ReleaseRequest{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n.(*File)
+}
+
+func testOpen(t *testing.T, f *File, flags int) *Handle {
+	h, err := f.Open(&fuse.OpenRequest{Flags: fuse.OpenFlags(flags)}, &fuse.OpenResponse{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return h.(*Handle)
+}
+
+func testRead(t *testing.T, h *Handle, off int64, size int) string {
+	resp := fuse.ReadResponse{Data: make([]byte, 0, size)}
+	err := h.Read(&fuse.ReadRequest{Offset: off, Size: size}, &resp, nil)
+	if err != nil && err != io.EOF {
+		t.Fatal(err)
+	}
+	return string(resp.Data)
+}
+
+func testWrite(t *testing.T, h *Handle, off int64, data string) {
+	resp := fuse.WriteResponse{}
+	err := h.Write(&fuse.WriteRequest{Offset: off, Data: []byte(data)}, &resp, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Size != len(data) {
+		t.Fatalf("wrote %d of %d bytes", resp.Size, len(data))
+	}
+}
+
+func testRelease(t *testing.T, h *Handle) {
+	err := h.Release(&fuse.ReleaseRequest{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// the staging copy starts out as the content, read from the start
+func TestHandleReadWritable(t *testing.T) {
+	f := testFS(t, 1)
+	file := testCreate(t, Dir{inode: root_inode, fs: f}, "f", "hello world")
+
+	for _, flags := range []int{syscall.O_RDWR, syscall.O_WRONLY, syscall.O_RDONLY} {
+		h := testOpen(t, file, flags)
+		if got := testRead(t, h, 0, 5); got != "hello" {
+			t.Errorf("flags %#x: read %q at 0", flags, got)
+		}
+		if got := testRead(t, h, 5, 100); got != " world" {
+			t.Errorf("flags %#x: read %q at 5", flags, got)
+		}
+		if got := testRead(t, h, 11, 100); got != "" {
+			t.Errorf("flags %#x: read %q at the end", flags, got)
+		}
+		testRelease(t, h)
+	}
+
+	h := testOpen(t, file, syscall.O_RDWR)
+	testWrite(t, h, 6, "there")
+	if got := testRead(t, h, 0, 100); got != "hello there" {
+		t.Errorf("read back %q", got)
+	}
+	testRelease(t, h)
+
+	h = testOpen(t, file, syscall.O_RDWR | syscall.O_TRUNC)
+	if got := testRead(t, h, 0, 100); got != "" {
+		t.Errorf("read %q after O_TRUNC", got)
+	}
+	testRelease(t, h)
+}
+
+func testWriteAs(t *testing.T, h *Handle, kid fuse.HandleID, off int64, data string) {
+	err := h.Write(&fuse.WriteRequest{Handle: kid, Offset: off, Data: []byte(data)}, &fuse.WriteResponse{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func testFtruncate(t *testing.T, file *File, kid fuse.HandleID, size uint64) {
+	req := fuse.SetattrRequest{Valid: fuse.SetattrSize | fuse.SetattrHandle, Handle: kid, Size: size}
+	err := file.Setattr(&req, &fuse.SetattrResponse{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func testTruncate(t *testing.T, file *File, size uint64) {
+	req := fuse.SetattrRequest{Valid: fuse.SetattrSize, Size: size}
+	err := file.Setattr(&req, &fuse.SetattrResponse{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func testContent(t *testing.T, file *File) string {
+	h := testOpen(t, file, syscall.O_RDONLY)
+	defer testRelease(t, h)
+	return testRead(t, h, 0, 4096)
+}
+
+func TestHandleTruncate(t *testing.T) {
+	f := testFS(t, 1)
+	root := Dir{inode: root_inode, fs: f}
+
+	// before any write: sealed now, and the handle's copy follows
+	file := testCreate(t, root, "fresh", "hello world")
+	h := testOpen(t, file, syscall.O_RDWR)
+	testFtruncate(t, file, 7, 3)
+	if got := testContent(t, file); got != "hel" {
+		t.Errorf("content %q after ftruncate", got)
+	}
+	if got := testRead(t, h, 0, 100); got != "hel" {
+		t.Errorf("handle reads %q after ftruncate", got)
+	}
+	testWriteAs(t, h, 7, 0, "XY")
+	testRelease(t, h)
+	if got := testContent(t, file); got != "XYl" {
+		t.Errorf("content %q after writing on", got)
+	}
+
+	// after writes: the handle's own copy, not another writer's
+	file = testCreate(t, root, "busy", "hello world")
+	h1 := testOpen(t, file, syscall.O_RDWR)
+	h2 := testOpen(t, file, syscall.O_RDWR)
+	testWriteAs(t, h1, 1, 0, "HELLO")
+	testWriteAs(t, h2, 2, 6, "WORLD")
+	testFtruncate(t, file, 1, 2)
+	if got := testRead(t, h1, 0, 100); got != "HE" {
+		t.Errorf("truncated handle reads %q", got)
+	}
+	if got := testRead(t, h2, 0, 100); got != "hello WORLD" {
+		t.Errorf("other writer reads %q", got)
+	}
+	testRelease(t, h2)
+	testRelease(t, h1)
+	if got := testContent(t, file); got != "HE" {
+		t.Errorf("content %q, last sealed should win", got)
+	}
+
+	// by path: unsealed writes still win, clean writers reload
+	file = testCreate(t, root, "path", "hello world")
+	h1 = testOpen(t, file, syscall.O_RDWR)
+	h2 = testOpen(t, file, syscall.O_RDWR)
+	testWriteAs(t, h1, 1, 0, "HELLO")
+	testTruncate(t, file, 4)
+	if got := testContent(t, file); got != "hell" {
+		t.Errorf("content %q after truncate", got)
+	}
+	if got := testRead(t, h2, 0, 100); got != "hell" {
+		t.Errorf("clean writer reads %q after truncate", got)
+	}
+	testRelease(t, h2)
+	testRelease(t, h1)
+	if got := testContent(t, file); got != "HELLO world" {
+		t.Errorf("content %q, unsealed writes should win", got)
+	}
+}
+
+// created handles come with their staging copy, read-only ones too
+func TestCreateHandle(t *testing.T) {
+	f := testFS(t, 1)
+	root := Dir{inode: root_inode, fs: f}
+	n, h, err := root.Create(&fuse.CreateRequest{Name: "ro", Flags: fuse.OpenFlags(syscall.O_RDONLY | syscall.O_CREAT), Mode: 0644}, &fuse.CreateResponse{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handle := h.(*Handle)
+	err = handle.Write(&fuse.WriteRequest{Data: []byte("x")}, &fuse.WriteResponse{}, nil)
+	if err != fuse.Errno(syscall.EBADF) {
+		t.Errorf("write to a read-only handle: %v", err)
+	}
+	if got := testRead(t, handle, 0, 100); got != "" {
+		t.Errorf("new file reads %q", got)
+	}
+	testRelease(t, handle)
+	if got := testContent(t, n.(*File)); got != "" {
+		t.Errorf("content %q", got)
+	}
+	staged, err := ioutil.ReadDir(f.stagingDir())
+	if err != nil || len(staged) != 0 {
+		t.Errorf("%d staging files left, %v", len(staged), err)
+	}
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"github.com/boltdb/bolt"
+	"log"
+)
+
+/* INODES
+
+"inodes": inode -> InodeRecord, little endian:
+	Type (byte) Size (u64) InodeAttr Content
+	every inode we have has one, and only it says what the inode is.
+	Size and Content are a file's, Content being its content reference,
+	see CHUNKS in chunk.go, and empty for empty files.  InodeAttr is
+	described in ATTRIBUTES.  directories keep their entries in "kids"
+	and symlinks their target in "symlinks", as before.
+
+databases from before records get them built from "filesize", "content",
+"attrs", "kids" and "symlinks" by a migration, see SCHEMA in schema.go,
+and the first three buckets go.  an inode some directory names without
+anything saying what it is becomes an empty file.
+*/
+
+const (
+	inode_file byte = 1 + iota
+	inode_dir
+	inode_symlink
+)
+
+type InodeRecord struct {
+	Type byte
+	Size uint64
+	Attr InodeAttr
+	Content []byte
+}
+
+const inode_record_fixed = 1 + 8 + inode_attr_len
+
+func (r *InodeRecord) Bytes() []byte {
+	buf := bytes.Buffer{}
+	buf.WriteByte(r.Type)
+	binary.Write(&buf, binary.LittleEndian, r.Size)
+	buf.Write(r.Attr.Bytes())
+	buf.Write(r.Content)
+	return buf.Bytes()
+}
+
+func InodeRecordFromBytes(b []byte) (*InodeRecord, error) {
+	if len(b) < inode_record_fixed {
+		return nil, errors.New("Bad inode record length")
+	}
+	r := InodeRecord{
+		Type: b[0],
+		Size: binary.LittleEndian.Uint64(b[1:9]),
+	}
+	a, err := InodeAttrFromBytes(b[9:inode_record_fixed])
+	if err != nil {
+		return nil, err
+	}
+	r.Attr = *a
+	if len(b) > inode_record_fixed {
+		r.Content = append([]byte{}, b[inode_record_fixed:]...)
+	}
+	return &r, nil
+}
+
+func new_inode_record(typ byte, a InodeAttr) *InodeRecord {
+	return &InodeRecord{Type: typ, Attr: a}
+}
+
+func inodes_index(tx *bolt.Tx) (*bolt.Bucket, error) {
+	b := tx.Bucket([]byte("inodes"))
+	if b == nil {
+		return nil, errors.New("Missing inodes bucket")
+	}
+	return b, nil
+}
+
+// the record of inode, nil if we don't have it
+func load_inode(tx *bolt.Tx, inode uint64) (*InodeRecord, error) {
+	b, err := inodes_index(tx)
+	if err != nil {
+		return nil, err
+	}
+	v := b.Get(uint64_b(inode))
+	if v == nil {
+		return nil, nil
+	}
+	return InodeRecordFromBytes(v)
+}
+
+func save_inode(tx *bolt.Tx, inode uint64, r *InodeRecord) error {
+	b, err := inodes_index(tx)
+	if err != nil {
+		return err
+	}
+	return b.Put(uint64_b(inode), r.Bytes())
+}
+
+// what inode is, 0 if we don't have it
+func inode_type(tx *bolt.Tx, inode uint64) (byte, error) {
+	r, err := load_inode(tx, inode)
+	if err != nil || r == nil {
+		return 0, err
+	}
+	return r.Type, nil
+}
+
+func (f *FS) InodeType(inode uint64) byte {
+	var typ byte
+	f.db.View(func(tx *bolt.Tx) error {
+		var err error
+		typ, err = inode_type(tx, inode)
+		return err
+	})
+	return typ
+}
+
+// build "inodes" for databases from before it
+func migrate_inodes(tx *bolt.Tx) error {
+	if tx.Bucket([]byte("inodes")) != nil {
+		return nil
+	}
+	if _, err := tx.CreateBucket([]byte("inodes")); err != nil {
+		return err
+	}
+	kids := tx.Bucket([]byte("kids"))
+	symlinks := tx.Bucket([]byte("symlinks"))
+	if kids == nil || symlinks == nil {
+		return errors.New("Missing kids or symlinks bucket")
+	}
+	fsizes := tx.Bucket([]byte("filesize"))
+	cb := tx.Bucket([]byte("content"))
+	ab := tx.Bucket([]byte("attrs"))
+
+	// every inode anything knows about
+	known := map[uint64]bool{root_inode: true}
+	add := func(k, v []byte) error {
+		known[b_uint64(k)] = true
+		return nil
+	}
+	for _, b := range []*bolt.Bucket{fsizes, cb, ab, symlinks} {
+		if b != nil {
+			b.ForEach(add)
+		}
+	}
+	err := kids.ForEach(func(dir, v []byte) error {
+		known[b_uint64(dir)] = true
+		dkids := kids.Bucket(dir)
+		if dkids == nil {
+			return nil
+		}
+		return dkids.ForEach(func(k, v []byte) error {
+			return add(v, nil)
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	for inode := range known {
+		key := uint64_b(inode)
+		var typ byte
+		switch {
+		case symlinks.Get(key) != nil:
+			typ = inode_symlink
+		case fsizes != nil && fsizes.Get(key) != nil:
+			typ = inode_file
+		case kids.Bucket(key) != nil:
+			typ = inode_dir
+		default:
+			log.Println("inode", inode, "has no type, making it an empty file")
+			typ = inode_file
+		}
+		r := new_inode_record(typ, default_attr(typ))
+		if ab != nil {
+			if v := ab.Get(key); v != nil {
+				a, err := InodeAttrFromBytes(v)
+				if err != nil {
+					return err
+				}
+				r.Attr = *a
+			}
+		}
+		if typ == inode_file {
+			if fsizes != nil && fsizes.Get(key) != nil {
+				r.Size = b_uint64(fsizes.Get(key))
+			}
+			if cb != nil && cb.Get(key) != nil {
+				r.Content = append([]byte{}, cb.Get(key)...)
+			}
+		}
+		err = save_inode(tx, inode, r)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, name := range []string{"filesize", "content", "attrs"} {
+		if tx.Bucket([]byte(name)) == nil {
+			continue
+		}
+		err = tx.DeleteBucket([]byte(name))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/boltdb/bolt"
+)
+
+// a database the way builds from before inode records left it
+func testOldDB(t *testing.T, buckets map[string]map[uint64][]byte, kids map[uint64]map[string]uint64) string {
+	storage := t.TempDir()
+	err := os.Mkdir(storage + "/files", 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := bolt.Open(storage + "/fs.bolt", 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for name, m := range buckets {
+			b, err := tx.CreateBucket([]byte(name))
+			if err != nil {
+				return err
+			}
+			for k, v := range m {
+				if err := b.Put(uint64_b(k), v); err != nil {
+					return err
+				}
+			}
+		}
+		kb, err := tx.CreateBucket([]byte("kids"))
+		if err != nil {
+			return err
+		}
+		for dir, names := range kids {
+			dkids, err := kb.CreateBucket(uint64_b(dir))
+			if err != nil {
+				return err
+			}
+			for name, inode := range names {
+				if err := dkids.Put([]byte(name), uint64_b(inode)); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	if cerr := db.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return storage
+}
+
+func TestMigrateInodes(t *testing.T) {
+	fattr := InodeAttr{Mode: 0600, Uid: 7, Gid: 8, Atime: 1, Mtime: 2, Ctime: 3}
+	ref := bytes.Repeat([]byte{0xcd}, 40)
+	storage := testOldDB(t, map[string]map[uint64][]byte{
+		"filesize": {3: uint64_b(5), 6: uint64_b(0)},
+		"content": {3: ref},
+		"attrs": {3: fattr.Bytes()},
+		"symlinks": {4: []byte("../target")},
+	}, map[uint64]map[string]uint64{
+		root_inode: {"d": 2, "f": 3, "l": 4, "lost": 5},
+		2: {"g": 6},
+	})
+
+	f, err := newfs(storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.CloseBolt()
+
+	want := map[uint64]InodeRecord{
+		root_inode: {Type: inode_dir, Attr: default_attr(inode_dir)},
+		2: {Type: inode_dir, Attr: default_attr(inode_dir)},
+		3: {Type: inode_file, Size: 5, Attr: fattr, Content: ref},
+		4: {Type: inode_symlink, Attr: default_attr(inode_symlink)},
+		5: {Type: inode_file, Attr: default_attr(inode_file)},
+		6: {Type: inode_file, Attr: default_attr(inode_file)},
+	}
+	err = f.db.View(func(tx *bolt.Tx) error {
+		for inode, w := range want {
+			r, err := load_inode(tx, inode)
+			if err != nil {
+				return err
+			}
+			if r == nil {
+				t.Errorf("inode %d has no record", inode)
+				continue
+			}
+			if !reflect.DeepEqual(*r, w) {
+				t.Errorf("inode %d: %+v, want %+v", inode, *r, w)
+			}
+		}
+		for _, name := range []string{"filesize", "content", "attrs"} {
+			if tx.Bucket([]byte(name)) != nil {
+				t.Errorf("%s is still there", name)
+			}
+		}
+		if db_schema(tx) != schema_version {
+			t.Errorf("schema %d, want %d", db_schema(tx), schema_version)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestInodeRecordCodec(t *testing.T) {
+	for _, r := range []InodeRecord{
+		{Type: inode_file, Size: 9, Attr: default_attr(inode_file), Content: []byte("ref")},
+		{Type: inode_dir, Attr: default_attr(inode_dir)},
+	} {
+		b := r.Bytes()
+		if len(b) != inode_record_fixed + len(r.Content) {
+			t.Errorf("%d byte record", len(b))
+		}
+		got, err := InodeRecordFromBytes(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(*got, r) {
+			t.Errorf("read %+v, want %+v", *got, r)
+		}
+	}
+	if _, err := InodeRecordFromBytes(make([]byte, inode_record_fixed - 1)); err == nil {
+		t.Error("took a short record")
+	}
+}
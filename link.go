@@ -0,0 +1,222 @@
+package main
+
+import (
+	"errors"
+	"github.com/boltdb/bolt"
+)
+
+/* LINKS
+
+"nlinks": inode -> how many names it has (u64)
+	missing means 1, which is every inode from before link counts.
+
+Dir.Link gives a file or symlink another name, in the same or another
+directory, logged as TX_LINK.  directories only ever have one.
+
+removing a name drops the count, and the last name going takes the
+inode with it.  if a handle still has it open, it becomes an orphan
+instead, and the last Release reclaims it:
+
+"orphans": inode -> nothing
+
+orphans keep their content and attributes for their handles, but
+sealing them is not logged, since nobody else can reach them.  orphans
+left over from a crash are reclaimed at startup.
+
+reclaiming drops everything the per-inode buckets hold for the inode,
+and for a directory unlinks everything in it.  blobs are left to gc.
+*/
+
+// buckets keyed by inode, emptied by reclaim and by gc
+var inode_buckets = []string{"inodes", "xattrs", "kids", "aliases", "zombies", "pins", "nlinks", "orphans", "symlinks", "parents"}
+
+func (f *FS) Nlink(tx *bolt.Tx, inode uint64) (uint64, error) {
+	b := tx.Bucket([]byte("nlinks"))
+	if b == nil {
+		return 0, errors.New("Missing nlinks bucket")
+	}
+	v := b.Get(uint64_b(inode))
+	if v == nil {
+		orphan, err := f.IsOrphan(tx, inode)
+		if err != nil || orphan {
+			return 0, err
+		}
+		return 1, nil
+	}
+	return b_uint64(v), nil
+}
+
+func (f *FS) setNlink(tx *bolt.Tx, inode uint64, n uint64) error {
+	b := tx.Bucket([]byte("nlinks"))
+	if b == nil {
+		return errors.New("Missing nlinks bucket")
+	}
+	if n == 1 {
+		return b.Delete(uint64_b(inode))
+	}
+	return b.Put(uint64_b(inode), uint64_b(n))
+}
+
+func (f *FS) IsOrphan(tx *bolt.Tx, inode uint64) (bool, error) {
+	b := tx.Bucket([]byte("orphans"))
+	if b == nil {
+		return false, errors.New("Missing orphans bucket")
+	}
+	return b.Get(uint64_b(inode)) != nil, nil
+}
+
+// how many handles have inode open
+func (f *FS) openHandles(inode uint64) int {
+	f.openmu.Lock()
+	defer f.openmu.Unlock()
+	return f.handles[inode]
+}
+
+// a name of inode went away
+func (f *FS) unlinkInode(tx *bolt.Tx, inode uint64) error {
+	if inode == root_inode {
+		return errors.New("Refusing to unlink the root")
+	}
+	n, err := f.Nlink(tx, inode)
+	if err != nil {
+		return err
+	}
+	if n > 1 {
+		return f.setNlink(tx, inode, n - 1)
+	}
+
+	// bolt serializes updates, so a Release racing with us either sees
+	// the orphan or we see its handle gone
+	if f.openHandles(inode) > 0 {
+		b := tx.Bucket([]byte("orphans"))
+		if b == nil {
+			return errors.New("Missing orphans bucket")
+		}
+		err = b.Put(uint64_b(inode), []byte{})
+		if err != nil {
+			return err
+		}
+		b = tx.Bucket([]byte("nlinks"))
+		if b == nil {
+			return errors.New("Missing nlinks bucket")
+		}
+		return b.Delete(uint64_b(inode))
+	}
+	return f.reclaimInode(tx, inode)
+}
+
+// forget inode, and unlink everything in it if it is a directory
+func (f *FS) reclaimInode(tx *bolt.Tx, inode uint64) error {
+	kids := tx.Bucket([]byte("kids"))
+	if kids == nil {
+		return errors.New("Missing kids bucket")
+	}
+	key := uint64_b(inode)
+
+	if dkids := kids.Bucket(key); dkids != nil {
+		names := [][]byte{}
+		dkids.ForEach(func(k, v []byte) error {
+			names = append(names, append([]byte{}, k...))
+			return nil
+		})
+		for _, name := range names {
+			kid := b_uint64(dkids.Get(name))
+			err := kid_delete(tx, dkids, inode, name)
+			if err != nil {
+				return err
+			}
+			err = f.unlinkInode(tx, kid)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, name := range inode_buckets {
+		b := tx.Bucket([]byte(name))
+		if b == nil {
+			return errors.New("Missing " + name + " bucket")
+		}
+		// bolt refuses to Delete a missing key in front of a bucket
+		var err error
+		if b.Bucket(key) != nil {
+			err = b.DeleteBucket(key)
+		} else if b.Get(key) != nil {
+			err = b.Delete(key)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	oids := tx.Bucket([]byte("oids"))
+	if oids == nil {
+		return errors.New("Missing oids bucket")
+	}
+	oidx := tx.Bucket([]byte("oidx"))
+	if oidx == nil {
+		return errors.New("Missing oidx bucket")
+	}
+	if oid := oids.Get(key); oid != nil {
+		err := oidx.Delete(append([]byte{}, oid...))
+		if err != nil {
+			return err
+		}
+		return oids.Delete(key)
+	}
+	return nil
+}
+
+// a handle on inode was opened
+func (f *FS) openHandle(inode uint64) {
+	f.openmu.Lock()
+	defer f.openmu.Unlock()
+	f.handles[inode]++
+}
+
+// a handle on inode went away, the last one of an orphan reclaims it
+func (f *FS) closeHandle(inode uint64) error {
+	f.openmu.Lock()
+	f.handles[inode]--
+	last := f.handles[inode] <= 0
+	if last {
+		delete(f.handles, inode)
+	}
+	f.openmu.Unlock()
+
+	if !last {
+		return nil
+	}
+	return f.db.Update(func(tx *bolt.Tx) error {
+		orphan, err := f.IsOrphan(tx, inode)
+		if err != nil || !orphan || f.openHandles(inode) > 0 {
+			return err
+		}
+		return f.reclaimInode(tx, inode)
+	})
+}
+
+// orphans nobody has open anymore
+func (f *FS) ReclaimOrphans() error {
+	return f.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("orphans"))
+		if b == nil {
+			return errors.New("Missing orphans bucket")
+		}
+		list := []uint64{}
+		b.ForEach(func(k, v []byte) error {
+			list = append(list, b_uint64(k))
+			return nil
+		})
+		for _, inode := range list {
+			if f.openHandles(inode) > 0 {
+				continue
+			}
+			err := f.reclaimInode(tx, inode)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"syscall"
+	"testing"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"github.com/boltdb/bolt"
+)
+
+func testUnlink(t *testing.T, d Dir, name string) {
+	err := d.Remove(&fuse.RemoveRequest{Name: name}, nil)
+	if err != nil {
+		t.Fatalf("unlink %s: %v", name, err)
+	}
+}
+
+func testOrphan(t *testing.T, f *FS, inode uint64) bool {
+	var orphan bool
+	err := f.db.View(func(tx *bolt.Tx) error {
+		var err error
+		orphan, err = f.IsOrphan(tx, inode)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return orphan
+}
+
+// the last name going takes the inode, unless a handle has it open
+func TestOrphanReclaim(t *testing.T) {
+	f := testFS(t, 1)
+	root := Dir{inode: root_inode, fs: f}
+	file := testCreate(t, root, "closed", "data")
+	testUnlink(t, root, "closed")
+	if f.InodeType(file.inode) != 0 || testOrphan(t, f, file.inode) {
+		t.Error("unlinked file without handles kept")
+	}
+
+	file = testCreate(t, root, "open", "data")
+	h := testOpen(t, file, syscall.O_RDONLY)
+	testUnlink(t, root, "open")
+	checkNames(t, "root", root)
+	if !testOrphan(t, f, file.inode) || f.InodeType(file.inode) != inode_file {
+		t.Fatal("open file not kept as an orphan")
+	}
+	if got := file.Attr().Nlink; got != 0 {
+		t.Errorf("orphan has nlink %d", got)
+	}
+	if got := testRead(t, h, 0, 100); got != "data" {
+		t.Errorf("orphan reads %q", got)
+	}
+	testRelease(t, h)
+	if f.InodeType(file.inode) != 0 || testOrphan(t, f, file.inode) {
+		t.Error("orphan kept after its last release")
+	}
+}
+
+// orphans left by a crash go at startup
+func TestReclaimOrphans(t *testing.T) {
+	f := testFS(t, 1)
+	root := Dir{inode: root_inode, fs: f}
+	file := testCreate(t, root, "f", "data")
+	testOpen(t, file, syscall.O_RDONLY)
+	testUnlink(t, root, "f")
+	if err := f.ReclaimOrphans(); err != nil {
+		t.Fatal(err)
+	}
+	if !testOrphan(t, f, file.inode) {
+		t.Fatal("reclaimed an orphan still open")
+	}
+
+	// as if we restarted without the handle
+	f.handles = map[uint64]int{}
+	if err := f.ReclaimOrphans(); err != nil {
+		t.Fatal(err)
+	}
+	if f.InodeType(file.inode) != 0 || testOrphan(t, f, file.inode) {
+		t.Error("orphan kept after restart")
+	}
+}
+
+func testLink(t *testing.T, d Dir, name string, old fs.Node) fs.Node {
+	n, err := d.Link(&fuse.LinkRequest{NewName: name}, old, nil)
+	if err != nil {
+		t.Fatalf("link %s: %v", name, err)
+	}
+	return n
+}
+
+// a file lives on under another name, and goes with the last one
+func TestLinkRemoveLast(t *testing.T) {
+	a := testFS(t, 1)
+	b := testFS(t, 2)
+	root := Dir{inode: root_inode, fs: a}
+	d := testMkdir(t, root, "d")
+	file := testCreate(t, root, "f", "data")
+	g := testLink(t, d, "g", file).(File)
+	if g.inode != file.inode || file.Attr().Nlink != 2 {
+		t.Fatalf("link is inode %d with nlink %d", g.inode, file.Attr().Nlink)
+	}
+	if _, err := d.Link(&fuse.LinkRequest{NewName: "g"}, file, nil); err != fuse.Errno(syscall.EEXIST) {
+		t.Errorf("link over g: %v", err)
+	}
+	if _, err := root.Link(&fuse.LinkRequest{NewName: "d2"}, d, nil); err != fuse.Errno(syscall.EPERM) {
+		t.Errorf("link to a directory: %v", err)
+	}
+
+	// b gets both names for one inode
+	testSync(t, a, b)
+	rb := Dir{inode: root_inode, fs: b}
+	fb, err := rb.Lookup("f", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gb, err := testLookupDir(t, rb, "d").Lookup("g", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fb.Attr().Inode != gb.Attr().Inode || gb.Attr().Nlink != 2 {
+		t.Errorf("b has f %d and g %d, nlink %d", fb.Attr().Inode, gb.Attr().Inode, gb.Attr().Nlink)
+	}
+
+	testUnlink(t, root, "f")
+	if file.Attr().Nlink != 1 || testContent(t, &g) != "data" {
+		t.Errorf("g has nlink %d", file.Attr().Nlink)
+	}
+	testUnlink(t, d, "g")
+	if a.InodeType(file.inode) != 0 {
+		t.Error("inode kept after its last name")
+	}
+
+	testSync(t, a, b)
+	checkNames(t, "b", rb, "d")
+	checkNames(t, "b d", testLookupDir(t, rb, "d"))
+	if b.InodeType(gb.Attr().Inode) != 0 {
+		t.Error("b kept the inode after its last name")
+	}
+}
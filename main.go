@@ -6,11 +6,20 @@ import (
 	"log"
 	"os"
 	"os/user"
+	"strings"
+	"time"
 
 	"bazil.org/fuse"
 	"bazil.org/fuse/fs"
 )
 
+var replicateAddr = flag.String("replicate", "", "listen for replication peers on this address (host:port)")
+var peerAddrs = flag.String("peers", "", "comma separated replication peers to connect to (host:port,...)")
+var cacheMB = flag.Int64("cache-mb", 0, "keep the blob cache under this many megabytes, evicting what peers hold (0 for no cap)")
+var gcEvery = flag.Duration("gc-every", time.Hour, "collect garbage this often (0 to only run GC from the admin console)")
+var migrateDryRun = flag.Bool("migrate-dry-run", false, "list the database migrations mounting would run, and exit without mounting")
+var fetchTimeout = flag.Duration("fetch-timeout", fetch_timeout, "give up fetching missing content from peers after this long, failing with EIO")
+
 var Usage = func() {
 	fmt.Fprintf(os.Stderr, "Usage of %s:\n", os.Args[0])
 	fmt.Fprintf(os.Stderr, "  %s MOUNTPOINT\n", os.Args[0])
@@ -33,7 +42,7 @@ func main() {
 	flag.Usage = Usage
 	flag.Parse()
 
-	if flag.NArg() != 1 {
+	if flag.NArg() != 1 && !*migrateDryRun {
 		Usage()
 		os.Exit(2)
 	}
@@ -43,6 +52,18 @@ func main() {
 		log.Fatal(err)
 	}
 
+	if *migrateDryRun {
+		from, ran, err := MigrateDryRun(you.HomeDir + "/fstorage")
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("schema %d, this build %d\n", from, schema_version)
+		for _, name := range ran {
+			fmt.Println("would migrate:", name)
+		}
+		return
+	}
+
 	if !exists(you.HomeDir + "/fstorage") {
 		err := os.Mkdir(you.HomeDir + "/fstorage", 0700)
 		if err != nil {
@@ -64,11 +85,38 @@ func main() {
 
 	myfs.DatabaseIDPrompt()
 
+	err = myfs.SealStagingFiles()
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = myfs.ReclaimOrphans()
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	err = myfs.SpawnAdminConsole()
 	if err != nil {
 		log.Fatal(err)
 	}
 
+	peers := []string{}
+	for _, p := range strings.Split(*peerAddrs, ",") {
+		p = strings.TrimSpace(p)
+		if p != "" {
+			peers = append(peers, p)
+		}
+	}
+	myfs.fetchTimeout = *fetchTimeout
+	myfs.cacheMax = *cacheMB * 1024 * 1024
+	myfs.SpawnEvictor()
+	myfs.SpawnPrefetcher()
+	myfs.SpawnGC(*gcEvery)
+
+	err = myfs.SpawnReplication(*replicateAddr, peers)
+	if err != nil {
+		log.Fatal(err)
+	}
+
 
 	mountpoint := flag.Arg(0)
 
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"github.com/boltdb/bolt"
+)
+
+/* OIDS
+
+FUSE inodes are local: each database hands them out from its own
+misc/lastinode counter.  transactions name objects by oid instead, which
+is the same on every replica:
+
+	oid = creator dbid << 48 | creator's local inode
+
+the root is oid 1 (root_inode) everywhere.  dbid 0 is never assigned, so
+a non-root oid with no dbid is a bare inode number from a transaction
+logged before oids existed, and means the sender's own local inode.
+
+"oids": our inode -> oid
+"oidx": oid -> our inode
+
+inodes created before oids existed have no "oids" entry, and are taken to
+be ours: oid = our dbid << 48 | inode.
+*/
+
+const oid_dbid_shift = 48
+const oid_inode_mask uint64 = 1<<oid_dbid_shift - 1
+
+func make_oid(dbid uint16, inode uint64) uint64 {
+	return uint64(dbid)<<oid_dbid_shift | inode&oid_inode_mask
+}
+
+func oid_dbid(oid uint64) uint16 {
+	return uint16(oid >> oid_dbid_shift)
+}
+
+// normalize an object reference from a transaction logged by dbid
+func tx_oid(dbid uint16, ref uint64) uint64 {
+	if ref == root_inode || ref == 0 || oid_dbid(ref) != 0 {
+		return ref
+	}
+	return make_oid(dbid, ref)
+}
+
+func (f *FS) Oid(tx *bolt.Tx, inode uint64) (uint64, error) {
+	if inode == root_inode {
+		return root_inode, nil
+	}
+	b := tx.Bucket([]byte("oids"))
+	if b == nil {
+		return 0, errors.New("Missing oids bucket")
+	}
+	v := b.Get(uint64_b(inode))
+	if v == nil {
+		return make_oid(f.dbid, inode), nil
+	}
+	return b_uint64(v), nil
+}
+
+// our inode for an oid, 0 if we don't have that object
+func (f *FS) InodeOf(tx *bolt.Tx, oid uint64) (uint64, error) {
+	if oid == root_inode {
+		return root_inode, nil
+	}
+	b := tx.Bucket([]byte("oidx"))
+	if b == nil {
+		return 0, errors.New("Missing oidx bucket")
+	}
+	v := b.Get(uint64_b(oid))
+	if v != nil {
+		return b_uint64(v), nil
+	}
+	if oid_dbid(oid) != f.dbid {
+		return 0, nil
+	}
+
+	// maybe one of ours from before oids
+	inode := oid & oid_inode_mask
+	oids := tx.Bucket([]byte("oids"))
+	if oids == nil {
+		return 0, errors.New("Missing oids bucket")
+	}
+	if oids.Get(uint64_b(inode)) != nil {
+		return 0, nil
+	}
+	return inode, nil
+}
+
+func (f *FS) setOid(tx *bolt.Tx, inode uint64, oid uint64) error {
+	oids := tx.Bucket([]byte("oids"))
+	if oids == nil {
+		return errors.New("Missing oids bucket")
+	}
+	oidx := tx.Bucket([]byte("oidx"))
+	if oidx == nil {
+		return errors.New("Missing oidx bucket")
+	}
+	err := oids.Put(uint64_b(inode), uint64_b(oid))
+	if err != nil {
+		return err
+	}
+	return oidx.Put(uint64_b(oid), uint64_b(inode))
+}
+
+// a fresh local inode for an object another database created
+func (f *FS) AdoptInode(tx *bolt.Tx, oid uint64) (uint64, error) {
+	inode, err := f.nextInode(tx)
+	if err != nil {
+		return 0, err
+	}
+	return inode, f.setOid(tx, inode, oid)
+}
+
+// the old "remoteinodes" bucket mapped dbid (u16) + their inode to ours
+func migrate_remoteinodes(tx *bolt.Tx) error {
+	b := tx.Bucket([]byte("remoteinodes"))
+	if b == nil {
+		return nil
+	}
+	oids := tx.Bucket([]byte("oids"))
+	oidx := tx.Bucket([]byte("oidx"))
+	if oids == nil || oidx == nil {
+		return errors.New("Missing oid buckets")
+	}
+	err := b.ForEach(func(k, v []byte) error {
+		if len(k) != 10 {
+			return errors.New("Bad remoteinodes key")
+		}
+		oid := tx_oid(binary.LittleEndian.Uint16(k[0:2]), binary.LittleEndian.Uint64(k[2:10]))
+		if err := oids.Put(v, uint64_b(oid)); err != nil {
+			return err
+		}
+		return oidx.Put(uint64_b(oid), v)
+	})
+	if err != nil {
+		return err
+	}
+	return tx.DeleteBucket([]byte("remoteinodes"))
+}
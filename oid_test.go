@@ -0,0 +1,121 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/boltdb/bolt"
+)
+
+func TestOidRefs(t *testing.T) {
+	oid := make_oid(0x0102, 0x345)
+	if oid_dbid(oid) != 0x0102 || oid & oid_inode_mask != 0x345 {
+		t.Errorf("oid %x", oid)
+	}
+	for _, c := range []struct {
+		ref, want uint64
+	}{
+		{root_inode, root_inode},
+		{0, 0},
+		{0x345, make_oid(7, 0x345)},
+		{oid, oid},
+	} {
+		if got := tx_oid(7, c.ref); got != c.want {
+			t.Errorf("tx_oid(7, %x) = %x, want %x", c.ref, got, c.want)
+		}
+	}
+}
+
+func testOid(t *testing.T, f *FS, inode uint64) uint64 {
+	var oid uint64
+	err := f.db.View(func(tx *bolt.Tx) error {
+		var err error
+		oid, err = f.Oid(tx, inode)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return oid
+}
+
+func testInodeOf(t *testing.T, f *FS, oid uint64) uint64 {
+	var inode uint64
+	err := f.db.View(func(tx *bolt.Tx) error {
+		var err error
+		inode, err = f.InodeOf(tx, oid)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return inode
+}
+
+// the same object has different inodes on a and b, and one oid
+func TestOidTranslation(t *testing.T) {
+	a := testFS(t, 1)
+	b := testFS(t, 2)
+	ra, rb := Dir{inode: root_inode, fs: a}, Dir{inode: root_inode, fs: b}
+	testMkdir(t, rb, "b1")
+	testMkdir(t, rb, "b2")
+	da := testMkdir(t, ra, "d")
+	testSync(t, a, b)
+
+	db := testLookupDir(t, rb, "d")
+	if db.inode == da.inode {
+		t.Fatalf("d is inode %d on both", da.inode)
+	}
+	oid := make_oid(1, da.inode)
+	if got := testOid(t, a, da.inode); got != oid {
+		t.Errorf("a: oid %x, want %x", got, oid)
+	}
+	if got := testOid(t, b, db.inode); got != oid {
+		t.Errorf("b: oid %x, want %x", got, oid)
+	}
+	if got := testInodeOf(t, b, oid); got != db.inode {
+		t.Errorf("b: oid %x is inode %d, want %d", oid, got, db.inode)
+	}
+	if got := testInodeOf(t, a, make_oid(3, da.inode)); got != 0 {
+		t.Errorf("a has inode %d for a database it never heard of", got)
+	}
+
+	// b's change to d lands in a's d
+	x := testMkdir(t, db, "x")
+	var logged *Tx
+	for _, txn := range testTxSince(t, b, map[uint16]uint64{}, repl_batch) {
+		// a's mkdir of d is in b's log too
+		if txn.Op == TX_MKDIR && txn.Dbid == 2 {
+			logged = txn
+		}
+	}
+	if logged.Inode != oid || logged.Inode2 != make_oid(2, x.inode) || logged.Oid != logged.Inode2 {
+		t.Errorf("b logged %+v", *logged)
+	}
+	testSync(t, a, b)
+	checkNames(t, "a d", testLookupDir(t, ra, "d"), "x")
+	xa := testLookupDir(t, testLookupDir(t, ra, "d"), "x")
+	if got := testOid(t, a, xa.inode); got != make_oid(2, x.inode) {
+		t.Errorf("a: x has oid %x", got)
+	}
+}
+
+// inodes from before oids count as ours
+func TestOidBeforeOids(t *testing.T) {
+	a := testFS(t, 1)
+	err := a.db.Update(func(tx *bolt.Tx) error {
+		inode, err := a.nextInode(tx)
+		if err != nil {
+			return err
+		}
+		if oid, err := a.Oid(tx, inode); err != nil || oid != make_oid(1, inode) {
+			t.Errorf("old inode %d has oid %x, %v", inode, oid, err)
+		}
+		if got, err := a.InodeOf(tx, make_oid(1, inode)); err != nil || got != inode {
+			t.Errorf("oid of old inode %d is inode %d, %v", inode, got, err)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
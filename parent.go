@@ -0,0 +1,198 @@
+package main
+
+import (
+	"errors"
+	"github.com/boltdb/bolt"
+	"os"
+	"strings"
+)
+
+/* PARENTS
+
+"parents": inode -> bucket of parent dir (u64) + name -> nothing
+	one entry for every name inode has in "kids", so a hard linked file
+	has several and a directory exactly one.  the root has none.
+
+everything that changes "kids" goes through kid_put and kid_delete,
+which keep it in step.  databases from before it get it built from
+"kids" by a migration, see SCHEMA in schema.go.
+
+FS.PathOf walks it up to the root.
+*/
+
+func parents_index(tx *bolt.Tx) (*bolt.Bucket, error) {
+	b := tx.Bucket([]byte("parents"))
+	if b == nil {
+		return nil, errors.New("Missing parents bucket")
+	}
+	return b, nil
+}
+
+func parent_key(dir uint64, name []byte) []byte {
+	return append(uint64_b(dir), name...)
+}
+
+func add_parent(tx *bolt.Tx, inode uint64, dir uint64, name []byte) error {
+	pb, err := parents_index(tx)
+	if err != nil {
+		return err
+	}
+	ip, err := pb.CreateBucketIfNotExists(uint64_b(inode))
+	if err != nil {
+		return err
+	}
+	return ip.Put(parent_key(dir, name), []byte{})
+}
+
+func drop_parent(tx *bolt.Tx, inode uint64, dir uint64, name []byte) error {
+	pb, err := parents_index(tx)
+	if err != nil {
+		return err
+	}
+	ip := pb.Bucket(uint64_b(inode))
+	if ip == nil {
+		return nil
+	}
+	err = ip.Delete(parent_key(dir, name))
+	if err != nil {
+		return err
+	}
+	if k, _ := ip.Cursor().First(); k == nil {
+		return pb.DeleteBucket(uint64_b(inode))
+	}
+	return nil
+}
+
+// point name in dir at val, whatever it named before
+func kid_put(tx *bolt.Tx, dkids *bolt.Bucket, dir uint64, name []byte, val []byte) error {
+	if old := dkids.Get(name); old != nil {
+		err := drop_parent(tx, b_uint64(old), dir, name)
+		if err != nil {
+			return err
+		}
+	}
+	// val may be a bolt value, only valid until the next write
+	val = append([]byte{}, val...)
+	err := dkids.Put(name, val)
+	if err != nil {
+		return err
+	}
+	return add_parent(tx, b_uint64(val), dir, name)
+}
+
+func kid_delete(tx *bolt.Tx, dkids *bolt.Bucket, dir uint64, name []byte) error {
+	old := dkids.Get(name)
+	if old == nil {
+		return nil
+	}
+	err := drop_parent(tx, b_uint64(old), dir, name)
+	if err != nil {
+		return err
+	}
+	return dkids.Delete(name)
+}
+
+type parentEntry struct {
+	dir uint64
+	name []byte
+}
+
+// every name inode has, in key order
+func parents_of(tx *bolt.Tx, inode uint64) ([]parentEntry, error) {
+	pb, err := parents_index(tx)
+	if err != nil {
+		return nil, err
+	}
+	list := []parentEntry{}
+	ip := pb.Bucket(uint64_b(inode))
+	if ip == nil {
+		return list, nil
+	}
+	err = ip.ForEach(func(k, v []byte) error {
+		if len(k) < 8 {
+			return errors.New("Bad parents key")
+		}
+		list = append(list, parentEntry{b_uint64(k[:8]), append([]byte{}, k[8:]...)})
+		return nil
+	})
+	return list, err
+}
+
+// the first parent of inode, 0 for the root or an unlinked inode
+func parent_of(tx *bolt.Tx, inode uint64) (uint64, []byte, error) {
+	pb, err := parents_index(tx)
+	if err != nil {
+		return 0, nil, err
+	}
+	ip := pb.Bucket(uint64_b(inode))
+	if ip == nil {
+		return 0, nil, nil
+	}
+	k, _ := ip.Cursor().First()
+	if k == nil {
+		return 0, nil, nil
+	}
+	if len(k) < 8 {
+		return 0, nil, errors.New("Bad parents key")
+	}
+	return b_uint64(k[:8]), append([]byte{}, k[8:]...), nil
+}
+
+// a path of inode from the root, as we show it.  for hard links, the
+// first of them.
+func path_of(tx *bolt.Tx, inode uint64) (string, error) {
+	names := []string{}
+	seen := map[uint64]bool{}
+	for inode != root_inode {
+		if seen[inode] {
+			return "", errors.New("Cycle in parents")
+		}
+		seen[inode] = true
+		dir, name, err := parent_of(tx, inode)
+		if err != nil {
+			return "", err
+		}
+		if dir == 0 {
+			return "", os.ErrNotExist
+		}
+		names = append(names, string(name))
+		inode = dir
+	}
+	for i, j := 0, len(names) - 1; i < j; i, j = i + 1, j - 1 {
+		names[i], names[j] = names[j], names[i]
+	}
+	return "/" + strings.Join(names, "/"), nil
+}
+
+func (f *FS) PathOf(inode uint64) (string, error) {
+	var path string
+	err := f.db.View(func(tx *bolt.Tx) error {
+		var err error
+		path, err = path_of(tx, inode)
+		return err
+	})
+	return path, err
+}
+
+// build "parents" for databases from before it
+func migrate_parents(tx *bolt.Tx) error {
+	if tx.Bucket([]byte("parents")) != nil {
+		return nil
+	}
+	if _, err := tx.CreateBucket([]byte("parents")); err != nil {
+		return err
+	}
+	kids := tx.Bucket([]byte("kids"))
+	if kids == nil {
+		return errors.New("Missing kids bucket")
+	}
+	return kids.ForEach(func(dir, v []byte) error {
+		dkids := kids.Bucket(dir)
+		if dkids == nil {
+			return nil
+		}
+		return dkids.ForEach(func(name, val []byte) error {
+			return add_parent(tx, b_uint64(val), b_uint64(dir), name)
+		})
+	})
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"os"
+	"testing"
+
+	"github.com/boltdb/bolt"
+)
+
+func testPathOf(t *testing.T, f *FS, inode uint64, want string) {
+	got, err := f.PathOf(inode)
+	if err != nil || got != want {
+		t.Errorf("inode %d is at %q, %v, want %q", inode, got, err, want)
+	}
+}
+
+func testParents(t *testing.T, f *FS, inode uint64) []parentEntry {
+	var list []parentEntry
+	err := f.db.View(func(tx *bolt.Tx) error {
+		var err error
+		list, err = parents_of(tx, inode)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return list
+}
+
+// a hard linked file has a parent for every name, and the path of the
+// first
+func TestPathOfLinks(t *testing.T) {
+	f := testFS(t, 1)
+	root := Dir{inode: root_inode, fs: f}
+	d := testMkdir(t, root, "d")
+	file := testCreate(t, d, "f", "data")
+	testPathOf(t, f, root_inode, "/")
+	testPathOf(t, f, d.inode, "/d")
+	testPathOf(t, f, file.inode, "/d/f")
+
+	testLink(t, root, "g", file)
+	if got := testParents(t, f, file.inode); len(got) != 2 {
+		t.Errorf("linked file has parents %v", got)
+	}
+	// the root sorts first
+	testPathOf(t, f, file.inode, "/g")
+
+	testUnlink(t, root, "g")
+	testPathOf(t, f, file.inode, "/d/f")
+	if err := testRename(root, "d", root, "e"); err != nil {
+		t.Fatal(err)
+	}
+	testPathOf(t, f, file.inode, "/e/f")
+
+	h := testOpen(t, file, os.O_RDONLY)
+	testUnlink(t, testLookupDir(t, root, "e"), "f")
+	if _, err := f.PathOf(file.inode); err != os.ErrNotExist {
+		t.Errorf("orphan has a path: %v", err)
+	}
+	if got := testParents(t, f, file.inode); len(got) != 0 {
+		t.Errorf("orphan has parents %v", got)
+	}
+	testRelease(t, h)
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"errors"
+	"github.com/boltdb/bolt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+/* PINS
+
+a pinned file, or everything under a pinned directory, is kept local:
+the prefetcher fetches whatever of it we don't have, and eviction leaves
+it alone.  pins belong to this database and are not logged.  set one
+with the user.fuboltfs.pin xattr (any value) or PIN in the admin
+console, remove it with removexattr or UNPIN.
+
+"pins": inode -> nothing
+*/
+
+const pin_xattr = "user.fuboltfs.pin"
+
+const prefetch_gap = 10 * time.Second
+const prefetch_every = 5 * time.Minute
+
+func pin_index(tx *bolt.Tx) (*bolt.Bucket, error) {
+	b := tx.Bucket([]byte("pins"))
+	if b == nil {
+		return nil, errors.New("Missing pins bucket")
+	}
+	return b, nil
+}
+
+func (f *FS) IsPinned(tx *bolt.Tx, inode uint64) (bool, error) {
+	pb, err := pin_index(tx)
+	if err != nil {
+		return false, err
+	}
+	return pb.Get(uint64_b(inode)) != nil, nil
+}
+
+func (f *FS) SetPin(inode uint64, pinned bool) error {
+	err := f.db.Update(func(tx *bolt.Tx) error {
+		pb, err := pin_index(tx)
+		if err != nil {
+			return err
+		}
+		if pinned {
+			return pb.Put(uint64_b(inode), []byte{})
+		}
+		return pb.Delete(uint64_b(inode))
+	})
+	if err == nil && pinned {
+		f.KickPrefetch()
+	}
+	return err
+}
+
+// content references of every file pinned directly or from above
+func (f *FS) pinnedContent(tx *bolt.Tx) ([][]byte, error) {
+	pb, err := pin_index(tx)
+	if err != nil {
+		return nil, err
+	}
+	seen := map[uint64]bool{}
+	refs := [][]byte{}
+	err = pb.ForEach(func(k, v []byte) error {
+		list, err := f.subtree(tx, b_uint64(k))
+		if err != nil {
+			return err
+		}
+		for _, inode := range list {
+			if seen[inode] {
+				continue
+			}
+			typ, err := inode_type(tx, inode)
+			if err != nil {
+				return err
+			}
+			if typ != inode_file {
+				continue
+			}
+			seen[inode] = true
+			ref, err := content_ref(tx, inode)
+			if err != nil {
+				return err
+			}
+			refs = append(refs, ref)
+		}
+		return nil
+	})
+	return refs, err
+}
+
+// blobs eviction has to leave alone.  chunks of manifests we don't have
+// can't be listed, but then we don't have them either.
+func (f *FS) PinnedBlobs() (map[string]bool, error) {
+	var refs [][]byte
+	err := f.db.View(func(tx *bolt.Tx) error {
+		var err error
+		refs, err = f.pinnedContent(tx)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	pinned := map[string]bool{}
+	for _, ref := range refs {
+		kind, hash, err := content_ref_split(ref)
+		if err != nil {
+			return nil, err
+		}
+		pinned[string(hash)] = true
+		if kind != content_manifest || !f.HasBlob(hash) {
+			continue
+		}
+		chunks, err := f.chunksOf(ref)
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range chunks {
+			pinned[string(c.hash)] = true
+		}
+	}
+	return pinned, nil
+}
+
+// fetch whatever pinned content we are missing
+func (f *FS) Prefetch() error {
+	var refs [][]byte
+	err := f.db.View(func(tx *bolt.Tx) error {
+		var err error
+		refs, err = f.pinnedContent(tx)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	// keep going past failures, the rest may be on another peer
+	var failed error
+	for _, ref := range refs {
+		chunks, err := f.chunksOf(ref)
+		if err != nil {
+			failed = err
+			continue
+		}
+		for _, c := range chunks {
+			err = f.ensureBlob(c.hash)
+			if err != nil {
+				failed = err
+			}
+		}
+	}
+	return failed
+}
+
+func (f *FS) KickPrefetch() {
+	select {
+	case f.prefetchkick <- struct{}{}:
+	default:
+	}
+}
+
+// prefetch when pins change, when the log grows, and every so often in
+// case a fetch failed
+func (f *FS) SpawnPrefetcher() {
+	go func() {
+		for {
+			select {
+			case <-f.prefetchkick:
+			case <-f.TxWait():
+			case <-time.After(prefetch_every):
+			}
+			err := f.Prefetch()
+			if err != nil {
+				log.Println("prefetch error:", err)
+			}
+			time.Sleep(prefetch_gap)
+		}
+	}()
+}
+
+// inode at path, from the root of the filesystem
+func (f *FS) ResolvePath(path string) (uint64, error) {
+	inode := root_inode
+	err := f.db.View(func(tx *bolt.Tx) error {
+		kids := tx.Bucket([]byte("kids"))
+		if kids == nil {
+			return errors.New("Missing kids bucket")
+		}
+		for _, name := range strings.Split(path, "/") {
+			if name == "" || name == "." {
+				continue
+			}
+			dkids := kids.Bucket(uint64_b(inode))
+			if dkids == nil {
+				return os.ErrNotExist
+			}
+			match := dkids.Get([]byte(name))
+			visible, err := f.Visible(tx, inode, []byte(name))
+			if err != nil {
+				return err
+			}
+			if match == nil || !visible {
+				return os.ErrNotExist
+			}
+			inode = b_uint64(match)
+		}
+		return nil
+	})
+	return inode, err
+}
+
+// paths of everything pinned, sorted
+func (f *FS) PinnedPaths() ([]string, error) {
+	paths := []string{}
+	err := f.db.View(func(tx *bolt.Tx) error {
+		pb, err := pin_index(tx)
+		if err != nil {
+			return err
+		}
+		kids := tx.Bucket([]byte("kids"))
+		if kids == nil {
+			return errors.New("Missing kids bucket")
+		}
+
+		var walk func(inode uint64, path string) error
+		walk = func(inode uint64, path string) error {
+			if pb.Get(uint64_b(inode)) != nil {
+				if path == "" {
+					paths = append(paths, "/")
+				} else {
+					paths = append(paths, path)
+				}
+			}
+			dkids := kids.Bucket(uint64_b(inode))
+			if dkids == nil {
+				return nil
+			}
+			return dkids.ForEach(func(k, v []byte) error {
+				return walk(b_uint64(v), path + "/" + string(k))
+			})
+		}
+		return walk(root_inode, "")
+	})
+	sort.Strings(paths)
+	return paths, err
+}
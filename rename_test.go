@@ -0,0 +1,210 @@
+package main
+
+import (
+	"reflect"
+	"syscall"
+	"testing"
+
+	"bazil.org/fuse"
+)
+
+func TestRenameErrors(t *testing.T) {
+	f := testFS(t, 1)
+	root := Dir{inode: root_inode, fs: f}
+	testCreate(t, root, "f", "F")
+	d := testMkdir(t, root, "d")
+	e := testMkdir(t, d, "e")
+	testMkdir(t, root, "empty")
+
+	for _, c := range []struct {
+		old string
+		nd Dir
+		name string
+		want syscall.Errno
+	}{
+		{"d", e, "x", syscall.EINVAL},
+		{"d", d, "x", syscall.EINVAL},
+		{"d", root, "f", syscall.ENOTDIR},
+		{"f", root, "d", syscall.EISDIR},
+		{"empty", root, "d", syscall.ENOTEMPTY},
+		{"nothere", root, "x", syscall.ENOENT},
+	} {
+		err := testRename(root, c.old, c.nd, c.name)
+		if err != fuse.Errno(c.want) {
+			t.Errorf("rename %s to %d/%s: %v, want %v", c.old, c.nd.inode, c.name, err, c.want)
+		}
+	}
+	checkNames(t, "root", root, "d", "empty", "f")
+	checkNames(t, "d", d, "e")
+
+	// a directory over an empty one is fine
+	if err := testRename(root, "d", root, "empty"); err != nil {
+		t.Fatal(err)
+	}
+	checkNames(t, "root", root, "empty", "f")
+	checkNames(t, "empty", testLookupDir(t, root, "empty"), "e")
+}
+
+func TestRenameOverwrite(t *testing.T) {
+	f := testFS(t, 1)
+	root := Dir{inode: root_inode, fs: f}
+	src := testCreate(t, root, "f", "new")
+	old := testCreate(t, root, "g", "old")
+
+	if err := testRename(root, "f", root, "g"); err != nil {
+		t.Fatal(err)
+	}
+	checkNames(t, "root", root, "g")
+	if f.IsFile(old.inode) {
+		t.Error("the replaced inode is still there")
+	}
+	n, err := root.Lookup("g", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n.Attr().Inode != src.inode {
+		t.Errorf("g is inode %d, want %d", n.Attr().Inode, src.inode)
+	}
+
+	// an open replaced inode lives until its last handle goes
+	old = testCreate(t, root, "h", "old")
+	h := testOpen(t, old, syscall.O_RDONLY)
+	if err := testRename(root, "g", root, "h"); err != nil {
+		t.Fatal(err)
+	}
+	if !f.IsFile(old.inode) {
+		t.Fatal("the replaced inode went while open")
+	}
+	if got := testRead(t, h, 0, 100); got != "old" {
+		t.Errorf("open replaced file reads %q", got)
+	}
+	testRelease(t, h)
+	if f.IsFile(old.inode) {
+		t.Error("the replaced inode is still there after its last handle")
+	}
+}
+
+// rename(2) does nothing when both names are the same inode
+func TestRenameSameInode(t *testing.T) {
+	f := testFS(t, 1)
+	root := Dir{inode: root_inode, fs: f}
+	file := testCreate(t, root, "f", "F")
+	_, err := root.Link(&fuse.LinkRequest{NewName: "f2"}, file, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	marks := testMarks(t, f)
+	if err := testRename(root, "f", root, "f2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := testRename(root, "f", root, "f"); err != nil {
+		t.Fatal(err)
+	}
+	checkNames(t, "root", root, "f", "f2")
+	if got := testMarks(t, f); !reflect.DeepEqual(got, marks) {
+		t.Errorf("logged %v, want nothing past %v", got, marks)
+	}
+	if a := file.Attr(); a.Nlink != 2 {
+		t.Errorf("nlink %d, want 2", a.Nlink)
+	}
+}
+
+// renameat2 flags, reachable through the admin console
+func TestRenameFlags(t *testing.T) {
+	a := testFS(t, 1)
+	b := testFS(t, 2)
+	root := Dir{inode: root_inode, fs: a}
+	file := testCreate(t, root, "f", "F")
+	d := testMkdir(t, root, "d")
+	e := testMkdir(t, d, "e")
+
+	for _, c := range []struct {
+		old, name string
+		flags uint32
+		want syscall.Errno
+	}{
+		{"f", "d", rename_noreplace, syscall.EEXIST},
+		{"f", "x", rename_exchange, syscall.ENOENT},
+		{"f", "d", rename_noreplace | rename_exchange, syscall.EINVAL},
+	} {
+		err := root.rename(c.old, root_inode, c.name, c.flags)
+		if err != fuse.Errno(c.want) {
+			t.Errorf("rename %s to %s with %d: %v, want %v", c.old, c.name, c.flags, err, c.want)
+		}
+	}
+	if err := root.rename("d", e.inode, "x", rename_noreplace); err != fuse.Errno(syscall.EINVAL) {
+		t.Errorf("moved d under itself: %v", err)
+	}
+	if err := d.rename("e", root_inode, "d", rename_exchange); err != fuse.Errno(syscall.EINVAL) {
+		t.Errorf("swapped d under itself: %v", err)
+	}
+	if err := root.rename("f", root_inode, "g", rename_noreplace); err != nil {
+		t.Fatal(err)
+	}
+	checkNames(t, "root", root, "d", "g")
+
+	testSync(t, a, b)
+	if got, err := a.TextCommand("SWAP /g /d/e"); err != nil || got != "OK" {
+		t.Fatalf("SWAP: %q, %v", got, err)
+	}
+	checkNames(t, "root", root, "d", "g")
+	if got := testLookupDir(t, root, "g"); got.inode != e.inode {
+		t.Errorf("g is inode %d, want e's %d", got.inode, e.inode)
+	}
+	if n, err := d.Lookup("e", nil); err != nil || n.Attr().Inode != file.inode {
+		t.Errorf("d/e is %v, %v, want f", n, err)
+	}
+
+	testSync(t, a, b)
+	rb := Dir{inode: root_inode, fs: b}
+	checkNames(t, "b", rb, "d", "g")
+	checkNames(t, "b g", testLookupDir(t, rb, "g"))
+	if n, err := testLookupDir(t, rb, "d").Lookup("e", nil); err != nil || n.Attr().Mode.IsDir() {
+		t.Errorf("b's d/e is %v, %v, want a file", n, err)
+	}
+}
+
+// another database's zombie we can't see keeps its copy when we use its
+// name
+func TestRenameOverHiddenZombie(t *testing.T) {
+	a := testFS(t, 1)
+	b := testFS(t, 2)
+	c := testFS(t, 3)
+	ra := Dir{inode: root_inode, fs: a}
+	rb := Dir{inode: root_inode, fs: b}
+	rc := Dir{inode: root_inode, fs: c}
+
+	testMkdir(t, ra, "d")
+	testSync(t, a, b)
+	testSync(t, a, c)
+	testMkdir(t, testLookupDir(t, rb, "d"), "x")
+	testSync(t, b, c)
+	testRmdir(t, ra, "d")
+	testSync(t, a, c)
+	if !hasEntry(t, c, root_inode, "d-ZOMBIE") {
+		t.Fatal("no hidden zombie")
+	}
+
+	// a file over a directory, ENOTEMPTY if we could see it
+	testCreate(t, rc, "f", "F")
+	if err := testRename(rc, "f", rc, "d-ZOMBIE"); err != nil {
+		t.Fatal(err)
+	}
+	checkNames(t, "c", rc, "d-ZOMBIE")
+	if !hasEntry(t, c, root_inode, "d-ZOMBIE-2") {
+		t.Fatal("hidden zombie dropped")
+	}
+
+	// the modifier restores it, and c gets it back
+	testSync(t, a, b)
+	if err := testRename(rb, "d-ZOMBIE", rb, "back"); err != nil {
+		t.Fatal(err)
+	}
+	testSync(t, b, c)
+	checkNames(t, "c", rc, "back", "d-ZOMBIE")
+	checkNames(t, "c back", testLookupDir(t, rc, "back"), "x")
+	if hasEntry(t, c, root_inode, "d-ZOMBIE-2") {
+		t.Error("hidden zombie kept after its restore")
+	}
+}
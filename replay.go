@@ -0,0 +1,367 @@
+package main
+
+import (
+	"errors"
+	"github.com/boltdb/bolt"
+	"log"
+	"time"
+)
+
+/* REPLAY
+
+transactions from other databases are applied straight to the buckets,
+never through Dir/File, so replaying does not log anything of its own.
+
+object references are oids, translated to our inodes through "oidx",
+see OIDS.
+
+"applied": dbid (u16) -> last txid applied from that database
+	the log is received in txid order per dbid, so this is the whole
+	set of applied (dbid, txid) pairs.
+
+anything that refers to a path or inode we don't have is skipped, so
+replay is idempotent and never wedges replication.
+*/
+
+// our inode for an object reference in a transaction from dbid, 0 if we
+// don't have it
+func (f *FS) replayInode(tx *bolt.Tx, dbid uint16, ref uint64) (uint64, error) {
+	return f.InodeOf(tx, tx_oid(dbid, ref))
+}
+
+// apply a transaction from another database, at most once
+func (f *FS) ReplayTx(tx *bolt.Tx, txn *Tx) error {
+	if txn.Dbid == f.dbid {
+		return errors.New("Refusing to replay our own transaction")
+	}
+
+	applied := tx.Bucket([]byte("applied"))
+	if applied == nil {
+		return errors.New("Missing applied bucket")
+	}
+	akey := uint16_b(txn.Dbid)
+	if txn.Txid <= b_uint64(applied.Get(akey)) {
+		return nil
+	}
+
+	var err error
+	switch txn.Op {
+	case TX_MKDIR, TX_CREATE, TX_SYMLINK:
+		err = f.replayNew(tx, txn)
+	case TX_REMOVE:
+		err = f.replayRemove(tx, txn)
+	case TX_RENAME:
+		err = f.replayRename(tx, txn)
+	case TX_SETCONTENT:
+		err = f.replaySetContent(tx, txn)
+	case TX_SETXATTR, TX_RMXATTR:
+		err = f.replayXattr(tx, txn)
+	case TX_LINK:
+		err = f.replayLink(tx, txn)
+	case TX_SETATTR:
+		err = f.replaySetAttr(tx, txn)
+	default:
+		// nothing local to do yet
+	}
+	if err != nil {
+		return err
+	}
+
+	return applied.Put(akey, uint64_b(txn.Txid))
+}
+
+func skip(txn *Tx, why string) error {
+	log.Println("replay: skipping dbid", txn.Dbid, "txid", txn.Txid, "op", txn.Op, why)
+	return nil
+}
+
+// our inode and kids bucket for a directory reference, nil if we don't
+// have it
+func (f *FS) replayKids(tx *bolt.Tx, dbid uint16, ref uint64) (uint64, *bolt.Bucket, error) {
+	kids := tx.Bucket([]byte("kids"))
+	if kids == nil {
+		return 0, nil, errors.New("Missing kids bucket")
+	}
+	local, err := f.replayInode(tx, dbid, ref)
+	if err != nil || local == 0 {
+		return 0, nil, err
+	}
+	return local, kids.Bucket(uint64_b(local)), nil
+}
+
+func (f *FS) replayNew(tx *bolt.Tx, txn *Tx) error {
+	kids := tx.Bucket([]byte("kids"))
+	if kids == nil {
+		return errors.New("Missing kids bucket")
+	}
+	dir, dkids, err := f.replayKids(tx, txn.Dbid, txn.Inode)
+	if err != nil {
+		return err
+	}
+	if dkids == nil {
+		return skip(txn, "parent missing")
+	}
+
+	oid := tx_oid(txn.Dbid, txn.Inode2)
+	existing, err := f.InodeOf(tx, oid)
+	if err != nil {
+		return err
+	}
+	if existing != 0 {
+		return skip(txn, "already created")
+	}
+
+	inode, err := f.AdoptInode(tx, oid)
+	if err != nil {
+		return err
+	}
+	val := uint64_b(inode)
+
+	// attributes follow as a TX_SETATTR
+	typ := inode_file
+	switch txn.Op {
+	case TX_MKDIR:
+		typ = inode_dir
+		_, err = kids.CreateBucket(val)
+	case TX_SYMLINK:
+		typ = inode_symlink
+		symlinks := tx.Bucket([]byte("symlinks"))
+		if symlinks == nil {
+			return errors.New("Missing symlinks bucket")
+		}
+		err = symlinks.Put(val, txn.Name2)
+	}
+	if err != nil {
+		return err
+	}
+	err = save_inode(tx, inode, new_inode_record(typ, default_attr(typ)))
+	if err != nil {
+		return err
+	}
+
+	if dkids.Get(txn.Name) != nil {
+		_, err = f.addAlias(tx, dir, dkids, txn.Dbid, txn.Name, val)
+		return err
+	}
+	return kid_put(tx, dkids, dir, txn.Name, val)
+}
+
+func (f *FS) replayRemove(tx *bolt.Tx, txn *Tx) error {
+	dir, dkids, err := f.replayKids(tx, txn.Dbid, txn.Inode)
+	if err != nil {
+		return err
+	}
+	if dkids == nil {
+		return skip(txn, "parent missing")
+	}
+	entry, err := f.replayEntry(tx, txn.Dbid, dir, dkids, txn.Name, txn.Oid)
+	if err != nil {
+		return err
+	}
+	if entry == nil {
+		// a zombie, given up by the database it was kept for
+		entry, err = f.replayZombie(tx, txn.Dbid, dir, dkids, txn.Name, txn.Oid)
+		if err != nil {
+			return err
+		}
+	}
+	if entry == nil {
+		return skip(txn, "path missing")
+	}
+	by, err := f.modifiedBy(tx, txn, b_uint64(dkids.Get(entry)))
+	if err != nil {
+		return err
+	}
+	if by != 0 {
+		return f.zombify(tx, dir, dkids, entry, by)
+	}
+	inode := b_uint64(dkids.Get(entry))
+	err = kid_delete(tx, dkids, dir, entry)
+	if err != nil {
+		return err
+	}
+	err = f.unlinkedName(tx, dir, dkids, entry)
+	if err != nil {
+		return err
+	}
+	return f.unlinkInode(tx, inode)
+}
+
+func (f *FS) replayLink(tx *bolt.Tx, txn *Tx) error {
+	dir, dkids, err := f.replayKids(tx, txn.Dbid, txn.Inode)
+	if err != nil {
+		return err
+	}
+	if dkids == nil {
+		return skip(txn, "parent missing")
+	}
+	target, err := f.replayInode(tx, txn.Dbid, txn.Inode2)
+	if err != nil {
+		return err
+	}
+	if target == 0 {
+		return skip(txn, "file missing")
+	}
+	typ, err := inode_type(tx, target)
+	if err != nil {
+		return err
+	}
+	if typ == inode_dir {
+		return skip(txn, "link to a directory")
+	}
+	n, err := f.Nlink(tx, target)
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return skip(txn, "file unlinked")
+	}
+	err = f.setNlink(tx, target, n + 1)
+	if err != nil {
+		return err
+	}
+
+	val := uint64_b(target)
+	if dkids.Get(txn.Name) != nil {
+		_, err = f.addAlias(tx, dir, dkids, txn.Dbid, txn.Name, val)
+		return err
+	}
+	return kid_put(tx, dkids, dir, txn.Name, val)
+}
+
+func (f *FS) replayRename(tx *bolt.Tx, txn *Tx) error {
+	dir, dkids, err := f.replayKids(tx, txn.Dbid, txn.Inode)
+	if err != nil {
+		return err
+	}
+	ndir, ndkids, err := f.replayKids(tx, txn.Dbid, txn.Inode2)
+	if err != nil {
+		return err
+	}
+	if dkids == nil || ndkids == nil {
+		return skip(txn, "directory missing")
+	}
+	entry, err := f.replayEntry(tx, txn.Dbid, dir, dkids, txn.Name, txn.Oid)
+	if err != nil {
+		return err
+	}
+	if entry == nil {
+		return skip(txn, "path missing")
+	}
+	if dir == ndir && string(entry) == string(txn.Name2) {
+		return nil
+	}
+	// bolt values are only valid until the next write
+	val := append([]byte{}, dkids.Get(entry)...)
+	if dir != ndir {
+		// both sides moving directories into each other
+		under, err := f.isUnder(tx, ndir, b_uint64(val))
+		if err != nil {
+			return err
+		}
+		if under {
+			return skip(txn, "would make a cycle")
+		}
+	}
+
+	// take it out first, it may be what frees up the new name
+	err = kid_delete(tx, dkids, dir, entry)
+	if err != nil {
+		return err
+	}
+	err = f.unlinkedName(tx, dir, dkids, entry)
+	if err != nil {
+		return err
+	}
+
+	if ndkids.Get(txn.Name2) != nil {
+		_, err = f.addAlias(tx, ndir, ndkids, txn.Dbid, txn.Name2, val)
+		return err
+	}
+	return kid_put(tx, ndkids, ndir, txn.Name2, val)
+}
+
+func (f *FS) replaySetContent(tx *bolt.Tx, txn *Tx) error {
+	inode, err := f.replayInode(tx, txn.Dbid, txn.Inode)
+	if err != nil {
+		return err
+	}
+	var r *InodeRecord
+	if inode != 0 {
+		r, err = load_inode(tx, inode)
+		if err != nil {
+			return err
+		}
+	}
+	if r == nil || r.Type != inode_file {
+		return skip(txn, "file missing")
+	}
+	if len(txn.Name) != 0 {
+		_, _, err = content_ref_split(txn.Name)
+		if err != nil {
+			return skip(txn, err.Error())
+		}
+		r.Content = txn.Name
+	}
+	// an empty Name is from before content had hashes
+	r.Size = txn.Inode2
+	r.Attr.Mtime = tx_time(txn)
+	r.Attr.Ctime = r.Attr.Mtime
+	return save_inode(tx, inode, r)
+}
+
+func (f *FS) replayXattr(tx *bolt.Tx, txn *Tx) error {
+	xtb := tx.Bucket([]byte("xattrs"))
+	if xtb == nil {
+		return errors.New("Missing xattrs bucket")
+	}
+	inode, err := f.replayInode(tx, txn.Dbid, txn.Inode)
+	if err != nil {
+		return err
+	}
+	if inode == 0 {
+		return skip(txn, "inode missing")
+	}
+	key := uint64_b(inode)
+
+	if txn.Op == TX_RMXATTR {
+		xb := xtb.Bucket(key)
+		if xb == nil {
+			return nil
+		}
+		return xb.Delete(txn.Name)
+	}
+
+	xb, err := xtb.CreateBucketIfNotExists(key)
+	if err != nil {
+		return err
+	}
+	return xb.Put(txn.Name, txn.Name2)
+}
+
+// when a transaction was made, in unix nanoseconds
+func tx_time(txn *Tx) int64 {
+	return time.Unix(int64(txn.Unix), 0).UnixNano()
+}
+
+func (f *FS) replaySetAttr(tx *bolt.Tx, txn *Tx) error {
+	inode, err := f.replayInode(tx, txn.Dbid, txn.Inode)
+	if err != nil {
+		return err
+	}
+	if inode == 0 {
+		return skip(txn, "inode missing")
+	}
+	t, err := TxAttrFromBytes(txn.Name)
+	if err != nil {
+		return skip(txn, err.Error())
+	}
+	a, err := load_attr(tx, inode)
+	if err != nil {
+		return err
+	}
+	// sizes come as TX_SETCONTENT, see ATTRIBUTES
+	a.apply(t)
+	a.Ctime = tx_time(txn)
+	return save_attr(tx, inode, a)
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"bazil.org/fuse"
+	"github.com/boltdb/bolt"
+)
+
+// every key in f's database, with its value
+func testDump(t *testing.T, f *FS) map[string]string {
+	dump := map[string]string{}
+	var walk func(path string, b *bolt.Bucket)
+	walk = func(path string, b *bolt.Bucket) {
+		b.ForEach(func(k, v []byte) error {
+			p := fmt.Sprintf("%s/%x", path, k)
+			if v == nil {
+				walk(p, b.Bucket(k))
+			} else {
+				dump[p] = fmt.Sprintf("%x", v)
+			}
+			return nil
+		})
+	}
+	err := f.db.View(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(name []byte, b *bolt.Bucket) error {
+			walk(string(name), b)
+			return nil
+		})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dump
+}
+
+func testReplay(t *testing.T, f *FS, list []*Tx) {
+	err := f.db.Update(func(tx *bolt.Tx) error {
+		for _, txn := range list {
+			if err := f.ReplayTx(tx, txn); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// a bit of everything, logged by a
+func replaySetup(t *testing.T) (*FS, []*Tx) {
+	a := testFS(t, 1)
+	root := Dir{inode: root_inode, fs: a}
+	d := testMkdir(t, root, "d")
+	file := testCreate(t, d, "f", "content")
+	err := file.Setxattr(&fuse.SetxattrRequest{Name: "user.x", Xattr: []byte("1")}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = file.Setattr(&fuse.SetattrRequest{Valid: fuse.SetattrMode, Mode: 0600}, &fuse.SetattrResponse{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = root.Link(&fuse.LinkRequest{NewName: "f2"}, file, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testMkdir(t, root, "gone")
+	testRmdir(t, root, "gone")
+	if err := testRename(d, "f", root, "g"); err != nil {
+		t.Fatal(err)
+	}
+	return a, testTxSince(t, a, map[uint16]uint64{}, repl_batch)
+}
+
+// every transaction applies once, however often it arrives
+func TestReplayIdempotent(t *testing.T) {
+	a, list := replaySetup(t)
+	b := testFS(t, 2)
+	testReplay(t, b, list)
+	once := testDump(t, b)
+
+	testReplay(t, b, list)
+	testReplay(t, b, list[len(list)/2:])
+	if again := testDump(t, b); !reflect.DeepEqual(again, once) {
+		t.Errorf("replaying again changed the database:\n%v\n%v", once, again)
+	}
+
+	rb := Dir{inode: root_inode, fs: b}
+	checkNames(t, "b", rb, "d", "f2", "g")
+	checkNames(t, "b d", testLookupDir(t, rb, "d"))
+	n, err := rb.Lookup("g", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := n.(File)
+	an, err := Dir{inode: root_inode, fs: a}.Lookup("g", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, _ := a.ContentRef(an.Attr().Inode)
+	cb, _ := b.ContentRef(g.inode)
+	if !reflect.DeepEqual(ca, cb) || g.LoadSize() != 7 {
+		t.Errorf("g has content %x, size %d, want %x", cb, g.LoadSize(), ca)
+	}
+	if at := g.Attr(); at.Mode & 0777 != 0600 || at.Nlink != 2 {
+		t.Errorf("g has mode %o, nlink %d", at.Mode, at.Nlink)
+	}
+	resp := fuse.GetxattrResponse{}
+	if err := g.Getxattr(&fuse.GetxattrRequest{Name: "user.x"}, &resp, nil); err != nil || string(resp.Xattr) != "1" {
+		t.Errorf("user.x is %q, %v", resp.Xattr, err)
+	}
+	if !reflect.DeepEqual(testNames(t, Dir{inode: root_inode, fs: a}), testNames(t, rb)) {
+		t.Error("a and b differ")
+	}
+}
+
+// what refers to things we don't have is skipped, not an error
+func TestReplaySkipsMissing(t *testing.T) {
+	_, list := replaySetup(t)
+	b := testFS(t, 2)
+	// without the TX_MKDIR for d, nothing in it or linked from it comes
+	testReplay(t, b, list[1:])
+	checkNames(t, "b", Dir{inode: root_inode, fs: b})
+	if got := testMarks(t, b); len(got) != 0 {
+		t.Errorf("replay logged %v", got)
+	}
+
+	// the entry a TX_SETATTR or TX_SETCONTENT was for never showed up
+	for _, txn := range list {
+		if txn.Op == TX_SETCONTENT || txn.Op == TX_SETATTR {
+			c := testFS(t, 3)
+			testReplay(t, c, []*Tx{txn})
+			checkNames(t, "c", Dir{inode: root_inode, fs: c})
+		}
+	}
+}
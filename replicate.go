@@ -0,0 +1,440 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"github.com/boltdb/bolt"
+	"io"
+	"log"
+	"math"
+	"net"
+	"sync"
+	"time"
+)
+
+/* REPLICATION
+
+every connection starts with both sides sending a hello:
+
+	magic "FUBO"
+	protocol version (u16)
+	purpose (byte)
+	dbid (u16)
+	count (u16), then count * { dbid (u16), txid (u64) }
+
+the dbid/txid pairs are the sender's high-water marks: the last
+transaction it holds from each database.  for a sync connection, each
+side then streams every transaction the other is missing, in txid order
+per dbid, using the Tx wire format, and keeps streaming as new ones are
+committed.  transactions are relayed, so a node only needs to reach one
+peer that eventually sees everyone else.  fetch and serve connections
+carry blobs instead, see FETCHING in fetch.go.
+
+everything is little endian.
+*/
+
+const repl_magic = "FUBO"
+// goes up with tx_version, so peers that can't read each other's
+// transactions part at the hello
+const repl_version uint16 = 5
+
+const (
+	repl_sync byte = 'S'
+	repl_fetch byte = 'G'
+	repl_serve byte = 'B'
+)
+
+const repl_batch = 1000
+const repl_redial = 10 * time.Second
+const repl_dial_timeout = 10 * time.Second
+
+type replHello struct {
+	Purpose byte
+	Dbid uint16
+	Marks map[uint16]uint64
+}
+
+// what we know the remote end of a connection holds
+type peerMarks struct {
+	mu sync.Mutex
+	marks map[uint16]uint64
+}
+
+func (pm *peerMarks) snapshot() map[uint16]uint64 {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	r := make(map[uint16]uint64, len(pm.marks))
+	for k, v := range pm.marks {
+		r[k] = v
+	}
+	return r
+}
+
+func (pm *peerMarks) set(dbid uint16, txid uint64) {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	if txid > pm.marks[dbid] {
+		pm.marks[dbid] = txid
+	}
+}
+
+func writeHello(w io.Writer, h *replHello) error {
+	buf := bytes.Buffer{}
+	buf.WriteString(repl_magic)
+	binary.Write(&buf, binary.LittleEndian, repl_version)
+	buf.WriteByte(h.Purpose)
+	binary.Write(&buf, binary.LittleEndian, h.Dbid)
+	binary.Write(&buf, binary.LittleEndian, uint16(len(h.Marks)))
+	for dbid, txid := range h.Marks {
+		binary.Write(&buf, binary.LittleEndian, dbid)
+		binary.Write(&buf, binary.LittleEndian, txid)
+	}
+	_, err := buf.WriteTo(w)
+	return err
+}
+
+func readHello(r io.Reader) (*replHello, error) {
+	magic := make([]byte, len(repl_magic))
+	_, err := io.ReadFull(r, magic)
+	if err != nil {
+		return nil, err
+	}
+	if string(magic) != repl_magic {
+		return nil, errors.New("Not a fuboltfs peer")
+	}
+
+	var version uint16
+	err = binary.Read(r, binary.LittleEndian, &version) ; if err != nil { return nil, err }
+	if version != repl_version {
+		return nil, errors.New("Unsupported replication protocol version")
+	}
+
+	h := replHello{Marks: map[uint16]uint64{}}
+	var n uint16
+
+	err = binary.Read(r, binary.LittleEndian, &h.Purpose) ; if err != nil { return nil, err }
+	err = binary.Read(r, binary.LittleEndian, &h.Dbid) ; if err != nil { return nil, err }
+	err = binary.Read(r, binary.LittleEndian, &n) ; if err != nil { return nil, err }
+	for i := uint16(0); i < n; i++ {
+		var dbid uint16
+		var txid uint64
+		err = binary.Read(r, binary.LittleEndian, &dbid) ; if err != nil { return nil, err }
+		err = binary.Read(r, binary.LittleEndian, &txid) ; if err != nil { return nil, err }
+		h.Marks[dbid] = txid
+	}
+	return &h, nil
+}
+
+// last txid in the log for dbid, 0 if none
+func tx_mark(b *bolt.Bucket, dbid uint16) uint64 {
+	c := b.Cursor()
+	last := tx_key(dbid, math.MaxUint64)
+	k, _ := c.Seek(last)
+	if k != nil && bytes.Equal(k, last) {
+		return math.MaxUint64
+	}
+	if k == nil {
+		k, _ = c.Last()
+	} else {
+		k, _ = c.Prev()
+	}
+	// step over version 1 keys, they have no place in the ordering
+	for k != nil && len(k) != 10 {
+		k, _ = c.Prev()
+	}
+	if k == nil || binary.BigEndian.Uint16(k) != dbid {
+		return 0
+	}
+	return binary.BigEndian.Uint64(k[2:])
+}
+
+// high-water marks for every dbid in the log
+func (f *FS) TxMarks(tx *bolt.Tx) (map[uint16]uint64, error) {
+	b := tx.Bucket([]byte("tx"))
+	if b == nil {
+		return nil, errors.New("Missing tx bucket")
+	}
+	marks := map[uint16]uint64{}
+
+	c := b.Cursor()
+	k, _ := c.First()
+	for k != nil {
+		if len(k) != 10 {
+			k, _ = c.Next()
+			continue
+		}
+		dbid := binary.BigEndian.Uint16(k)
+		marks[dbid] = tx_mark(b, dbid)
+		if dbid == math.MaxUint16 {
+			break
+		}
+		k, _ = c.Seek(tx_key(dbid + 1, 0))
+	}
+	return marks, nil
+}
+
+// up to max transactions the holder of marks is missing, in order per dbid
+func (f *FS) TxSince(tx *bolt.Tx, marks map[uint16]uint64, max int) ([]*Tx, error) {
+	b := tx.Bucket([]byte("tx"))
+	if b == nil {
+		return nil, errors.New("Missing tx bucket")
+	}
+	ours, err := f.TxMarks(tx)
+	if err != nil {
+		return nil, err
+	}
+
+	list := []*Tx{}
+	c := b.Cursor()
+	for dbid, last := range ours {
+		have := marks[dbid]
+		if have >= last {
+			continue
+		}
+		for k, v := c.Seek(tx_key(dbid, have + 1)); k != nil; k, v = c.Next() {
+			if len(k) != 10 || binary.BigEndian.Uint16(k) != dbid {
+				break
+			}
+			txn, err := TxFromKV(k, v)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, txn)
+			if len(list) >= max {
+				return list, nil
+			}
+		}
+	}
+	return list, nil
+}
+
+// store and apply a transaction from another database, skipping ones we
+// already hold.  txids of a database go up by one, so anything past the
+// next one means the stream lost some, and the connection has to start
+// over from our marks.  a log we have nothing of yet may start past 1,
+// version 1 records from before it are never sent.
+func (f *FS) ReceiveTx(tx *bolt.Tx, txn *Tx) error {
+	b := tx.Bucket([]byte("tx"))
+	if b == nil {
+		return errors.New("Missing tx bucket")
+	}
+	mark := tx_mark(b, txn.Dbid)
+	if txn.Txid <= mark {
+		return nil
+	}
+	if mark != 0 && txn.Txid != mark + 1 {
+		return errors.New("Transaction out of sequence")
+	}
+	err := txn.Save(tx)
+	if err != nil {
+		return err
+	}
+	err = f.ReplayTx(tx, txn)
+	if err != nil {
+		return err
+	}
+	tx.OnCommit(f.TxNotify)
+	return nil
+}
+
+// wake up anyone waiting in TxWait.  call after a commit that grew the log.
+func (f *FS) TxNotify() {
+	f.txsigmu.Lock()
+	defer f.txsigmu.Unlock()
+	if f.txsig != nil {
+		close(f.txsig)
+	}
+	f.txsig = make(chan struct{})
+}
+
+// closed on the next TxNotify
+func (f *FS) TxWait() <-chan struct{} {
+	f.txsigmu.Lock()
+	defer f.txsigmu.Unlock()
+	if f.txsig == nil {
+		f.txsig = make(chan struct{})
+	}
+	return f.txsig
+}
+
+func (f *FS) SpawnReplication(listen string, peers []string) error {
+	if listen != "" {
+		l, err := net.Listen("tcp", listen)
+		if err != nil {
+			return err
+		}
+
+		go func() {
+			for {
+				conn, err := l.Accept()
+				if err != nil {
+					log.Println("replication accept error:", err)
+				} else {
+					go f.handlePeer(conn, "")
+				}
+			}
+		}()
+	}
+
+	for _, peer := range peers {
+		go f.dialPeer(peer)
+	}
+
+	return nil
+}
+
+// keep a sync connection to peer open forever
+func (f *FS) dialPeer(peer string) {
+	for {
+		conn, err := net.DialTimeout("tcp", peer, repl_dial_timeout)
+		if err != nil {
+			log.Println("replication dial error:", err)
+		} else {
+			f.handlePeer(conn, peer)
+		}
+		time.Sleep(repl_redial)
+	}
+}
+
+// run a connection with a peer.  addr is where we dialed it, "" if it
+// dialed us.
+func (f *FS) handlePeer(conn net.Conn, addr string) {
+	defer conn.Close()
+
+	reader := bufio.NewReader(conn)
+
+	var marks map[uint16]uint64
+	err := f.db.View(func(tx *bolt.Tx) error {
+		var err error
+		marks, err = f.TxMarks(tx)
+		return err
+	})
+	if err != nil {
+		log.Println("replication marks error:", err)
+		return
+	}
+
+	err = writeHello(conn, &replHello{Purpose: repl_sync, Dbid: f.dbid, Marks: marks})
+	if err != nil {
+		log.Println("replication write error:", err)
+		return
+	}
+	hello, err := readHello(reader)
+	if err != nil {
+		log.Println("replication hello error:", err)
+		return
+	}
+	if hello.Dbid == f.dbid {
+		log.Println("replication hello error: peer", conn.RemoteAddr(), "has our dbid", f.dbid)
+		return
+	}
+	if hello.Purpose == repl_fetch {
+		f.serveFetch(conn, reader)
+		return
+	}
+	if hello.Purpose == repl_serve {
+		fc := newFetchConn(conn, reader)
+		f.setFetchConn(hello.Dbid, fc)
+		<-fc.dead
+		return
+	}
+	if hello.Purpose != repl_sync {
+		log.Println("replication hello error: unknown purpose", hello.Purpose)
+		return
+	}
+
+	log.Println("replicating with dbid", hello.Dbid, "at", conn.RemoteAddr())
+
+	err = f.savePeerMark(hello.Dbid, hello.Marks[f.dbid])
+	if err != nil {
+		log.Println("replication peer mark error:", err)
+		return
+	}
+
+	f.peerUp(hello.Dbid, addr)
+	defer f.peerDown(hello.Dbid)
+
+	pm := &peerMarks{marks: hello.Marks}
+	done := make(chan struct{})
+	go f.replSend(conn, pm, done)
+	if addr != "" {
+		go f.serveBack(addr, hello.Dbid, done)
+	}
+
+	for {
+		txn, err := TxReadFrom(reader)
+		if err == io.EOF {
+			log.Println("replication with dbid", hello.Dbid, "closed")
+			break
+		}
+		if err != nil {
+			log.Println("replication read error:", err)
+			break
+		}
+		pm.set(txn.Dbid, txn.Txid)
+		if txn.Dbid == f.dbid {
+			// ours, relayed back to us
+			continue
+		}
+
+		err = f.db.Update(func(tx *bolt.Tx) error {
+			return f.ReceiveTx(tx, txn)
+		})
+		if err != nil {
+			log.Println("replication receive error:", err)
+			break
+		}
+	}
+
+	close(done)
+}
+
+// stream what the peer is missing until the connection dies
+func (f *FS) replSend(conn net.Conn, pm *peerMarks, done chan struct{}) {
+	writer := bufio.NewWriter(conn)
+
+	for {
+		// grab this before looking, so a commit in between still wakes us
+		wait := f.TxWait()
+
+		var list []*Tx
+		err := f.db.View(func(tx *bolt.Tx) error {
+			var err error
+			list, err = f.TxSince(tx, pm.snapshot(), repl_batch)
+			return err
+		})
+		if err != nil {
+			log.Println("replication log error:", err)
+			conn.Close()
+			return
+		}
+
+		for _, txn := range list {
+			_, err = txn.WriteTo(writer)
+			if err != nil {
+				log.Println("replication write error:", err)
+				conn.Close()
+				return
+			}
+			pm.set(txn.Dbid, txn.Txid)
+		}
+		err = writer.Flush()
+		if err != nil {
+			log.Println("replication write flush error:", err)
+			conn.Close()
+			return
+		}
+
+		if len(list) >= repl_batch {
+			continue
+		}
+
+		select {
+		case <-wait:
+		case <-done:
+			return
+		}
+	}
+}
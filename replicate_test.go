@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"testing"
+
+	"github.com/boltdb/bolt"
+)
+
+func TestHelloRoundTrip(t *testing.T) {
+	for _, h := range []replHello{
+		{Purpose: repl_sync, Dbid: 3, Marks: map[uint16]uint64{}},
+		{Purpose: repl_fetch, Dbid: 0xffff, Marks: map[uint16]uint64{1: 5, 2: 1 << 40, 0xffff: 1}},
+	} {
+		buf := bytes.Buffer{}
+		if err := writeHello(&buf, &h); err != nil {
+			t.Fatal(err)
+		}
+		wire := buf.Bytes()
+		got, err := readHello(bytes.NewReader(wire))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(*got, h) {
+			t.Errorf("read %+v, want %+v", *got, h)
+		}
+		for i := 0; i < len(wire); i++ {
+			if _, err := readHello(bytes.NewReader(wire[:i])); err == nil {
+				t.Errorf("took %d of %d bytes", i, len(wire))
+			}
+		}
+	}
+
+	buf := bytes.Buffer{}
+	writeHello(&buf, &replHello{Purpose: repl_sync, Dbid: 1, Marks: map[uint16]uint64{}})
+	bad := append([]byte{}, buf.Bytes()...)
+	bad[0] = 'X'
+	if _, err := readHello(bytes.NewReader(bad)); err == nil {
+		t.Error("took a bad magic")
+	}
+	bad = append([]byte{}, buf.Bytes()...)
+	binary.LittleEndian.PutUint16(bad[len(repl_magic):], repl_version - 1)
+	if _, err := readHello(bytes.NewReader(bad)); err == nil {
+		t.Error("took an older protocol version")
+	}
+}
+
+// the log of f past marks
+func testTxSince(t *testing.T, f *FS, marks map[uint16]uint64, max int) []*Tx {
+	var list []*Tx
+	err := f.db.View(func(tx *bolt.Tx) error {
+		var err error
+		list, err = f.TxSince(tx, marks, max)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return list
+}
+
+func TestTxSince(t *testing.T) {
+	a := testFS(t, 1)
+	root := Dir{inode: root_inode, fs: a}
+	for _, name := range []string{"a", "b", "c", "d"} {
+		testMkdir(t, root, name)
+	}
+	last := testMarks(t, a)[1]
+
+	all := testTxSince(t, a, map[uint16]uint64{}, repl_batch)
+	if uint64(len(all)) != last {
+		t.Fatalf("%d transactions for a log up to %d", len(all), last)
+	}
+	for i, txn := range all {
+		if txn.Dbid != 1 || txn.Txid != uint64(i) + 1 {
+			t.Errorf("transaction %d is %d/%d", i, txn.Dbid, txn.Txid)
+		}
+	}
+	if got := testTxSince(t, a, map[uint16]uint64{1: last - 2}, repl_batch); len(got) != 2 || got[0].Txid != last - 1 {
+		t.Errorf("past %d: %d transactions", last - 2, len(got))
+	}
+	if got := testTxSince(t, a, map[uint16]uint64{}, 3); len(got) != 3 || got[2].Txid != 3 {
+		t.Errorf("batch of 3: %d transactions", len(got))
+	}
+	if got := testTxSince(t, a, map[uint16]uint64{1: last}, repl_batch); len(got) != 0 {
+		t.Errorf("up to date: %d transactions", len(got))
+	}
+}
+
+func TestReceiveTxSequence(t *testing.T) {
+	a := testFS(t, 1)
+	b := testFS(t, 2)
+	root := Dir{inode: root_inode, fs: a}
+	for _, name := range []string{"a", "b", "c"} {
+		testMkdir(t, root, name)
+	}
+	all := testTxSince(t, a, map[uint16]uint64{}, repl_batch)
+
+	receive := func(txn *Tx) error {
+		return b.db.Update(func(tx *bolt.Tx) error {
+			return b.ReceiveTx(tx, txn)
+		})
+	}
+	if err := receive(all[0]); err != nil {
+		t.Fatal(err)
+	}
+	if err := receive(all[2]); err == nil {
+		t.Error("took a transaction past a gap")
+	}
+	if got := testMarks(t, b)[1]; got != 1 {
+		t.Errorf("mark %d after the gap, want 1", got)
+	}
+	for _, txn := range all {
+		// the first one again is skipped
+		if err := receive(txn); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !reflect.DeepEqual(testMarks(t, b), testMarks(t, a)) {
+		t.Errorf("marks %v, want %v", testMarks(t, b), testMarks(t, a))
+	}
+	checkNames(t, "b", Dir{inode: root_inode, fs: b}, "a", "b", "c")
+}
+
+// changes made while connected stream over, and get relayed on
+func TestReplicateStream(t *testing.T) {
+	a := testFS(t, 1)
+	b := testFS(t, 2)
+	c := testFS(t, 3)
+	testMkdir(t, Dir{inode: root_inode, fs: a}, "before")
+
+	defer testConnect(t, a, b)()
+	defer testConnect(t, b, c)()
+	testSynced(t, a, c)
+	checkNames(t, "c", Dir{inode: root_inode, fs: c}, "before")
+
+	testMkdir(t, Dir{inode: root_inode, fs: c}, "from-c")
+	testMkdir(t, Dir{inode: root_inode, fs: a}, "from-a")
+	testSynced(t, a, b)
+	testSynced(t, b, c)
+	testSynced(t, a, c)
+	for _, f := range []*FS{a, b, c} {
+		checkNames(t, "everyone", Dir{inode: root_inode, fs: f}, "before", "from-a", "from-c")
+	}
+}
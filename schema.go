@@ -0,0 +1,199 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/boltdb/bolt"
+	"log"
+	"os"
+	"time"
+)
+
+/* SCHEMA
+
+"misc" "schema": how many of the migrations below the database has had
+	(u64).  missing in databases from before it, which counts as 0.
+
+opening a database runs the migrations it hasn't had, in order, in one
+bolt transaction, so it either gets all of them or none.  before any of
+them touch an existing database, it is copied to
+
+	storagepath/fs.bolt.schema-<version>.bak
+
+a database with a schema newer than this build knows is refused.
+
+migrations are only ever appended.  each one has to cope with being run
+on a database that already has its change, since databases from before
+the schema number had some of them done on every open.
+
+the transaction format has its own version, see FORMAT in tx.go.
+*/
+
+type migration struct {
+	name string
+	run func(tx *bolt.Tx) error
+}
+
+var migrations = []migration{
+	{"buckets", migrate_buckets},
+	{"oids from remoteinodes", migrate_remoteinodes},
+	{"parents index", migrate_parents},
+	{"inode records", migrate_inodes},
+}
+
+var schema_version = uint64(len(migrations))
+
+var schema_key = []byte("schema")
+
+// every bucket, as of the first schema
+func migrate_buckets(tx *bolt.Tx) error {
+	for _, name := range []string{"misc", "xattrs", "blobcache", "pins", "peermarks", "nlinks", "orphans", "symlinks", "tx", "oids", "oidx", "applied", "aliases", "zombies"} {
+		if _, err := tx.CreateBucketIfNotExists([]byte(name)); err != nil {
+			return err
+		}
+	}
+	cb, err := tx.CreateBucketIfNotExists([]byte("kids"))
+	if err != nil {
+		return err
+	}
+	_, err = cb.CreateBucketIfNotExists(uint64_b(root_inode))
+	return err
+}
+
+// the schema version of the database, 0 for none yet
+func db_schema(tx *bolt.Tx) uint64 {
+	b := tx.Bucket([]byte("misc"))
+	if b == nil {
+		return 0
+	}
+	return b_uint64(b.Get(schema_key))
+}
+
+// run what the database is missing.  returns the names of what ran.
+func migrate(tx *bolt.Tx) ([]string, error) {
+	from := db_schema(tx)
+	if from > schema_version {
+		return nil, fmt.Errorf("Database schema %d is newer than this build knows (%d)", from, schema_version)
+	}
+	ran := []string{}
+	for i := from; i < schema_version; i++ {
+		m := migrations[i]
+		err := m.run(tx)
+		if err != nil {
+			return ran, fmt.Errorf("Migration %d (%s) failed: %v", i + 1, m.name, err)
+		}
+		ran = append(ran, m.name)
+	}
+	if from == schema_version {
+		return ran, nil
+	}
+	b := tx.Bucket([]byte("misc"))
+	if b == nil {
+		return ran, errors.New("Missing misc bucket")
+	}
+	return ran, b.Put(schema_key, uint64_b(schema_version))
+}
+
+// copy of db as it is, next to path
+func backup_db(db *bolt.DB, path string) (string, error) {
+	var bak string
+	err := db.View(func(tx *bolt.Tx) error {
+		if tx.Bucket([]byte("misc")) == nil {
+			// nothing in it yet
+			return nil
+		}
+		bak = fmt.Sprintf("%s.schema-%d.bak", path, db_schema(tx))
+		fh, err := os.OpenFile(bak, os.O_WRONLY | os.O_CREATE | os.O_TRUNC, 0600)
+		if err != nil {
+			return err
+		}
+		_, err = tx.WriteTo(fh)
+		if cerr := fh.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			os.Remove(bak)
+		}
+		return err
+	})
+	return bak, err
+}
+
+// bring the database at path up to schema_version, backing it up first
+func upgrade(db *bolt.DB, path string) error {
+	var from uint64
+	err := db.View(func(tx *bolt.Tx) error {
+		from = db_schema(tx)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if from == schema_version {
+		return nil
+	}
+	if from < schema_version {
+		bak, err := backup_db(db, path)
+		if err != nil {
+			return fmt.Errorf("Backup before upgrading failed: %v", err)
+		}
+		if bak != "" {
+			log.Println("database backed up to", bak)
+		}
+	}
+	var ran []string
+	err = db.Update(func(tx *bolt.Tx) error {
+		var err error
+		ran, err = migrate(tx)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	for _, name := range ran {
+		log.Println("database migrated:", name)
+	}
+	return nil
+}
+
+var errDryRun = errors.New("dry run")
+
+// how long a dry run waits for the lock a mounted filesystem holds
+const dry_run_timeout = time.Second
+
+// what opening the database in storage would migrate, without changing
+// it.  the migrations do run, and are rolled back.
+func MigrateDryRun(storage string) (uint64, []string, error) {
+	if _, err := os.Stat(storage + "/fs.bolt"); os.IsNotExist(err) {
+		// a new database gets everything
+		ran := []string{}
+		for _, m := range migrations {
+			ran = append(ran, m.name)
+		}
+		return 0, ran, nil
+	}
+	db, err := bolt.Open(storage + "/fs.bolt", 0600, &bolt.Options{Timeout: dry_run_timeout})
+	if err == bolt.ErrTimeout {
+		return 0, nil, errors.New("Database is busy, is the filesystem mounted?")
+	}
+	if err != nil {
+		return 0, nil, err
+	}
+	defer db.Close()
+
+	var from uint64
+	var ran []string
+	err = db.Update(func(tx *bolt.Tx) error {
+		from = db_schema(tx)
+		var err error
+		ran, err = migrate(tx)
+		if err != nil {
+			return err
+		}
+		return errDryRun
+	})
+	if err == errDryRun {
+		err = nil
+	}
+	return from, ran, err
+}
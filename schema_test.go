@@ -0,0 +1,175 @@
+package main
+
+import (
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/boltdb/bolt"
+)
+
+// a database at schema, with nothing else in it
+func testSchemaDB(t *testing.T, schema uint64) string {
+	storage := testOldDB(t, map[string]map[uint64][]byte{
+		"misc": {},
+		"symlinks": {},
+	}, map[uint64]map[string]uint64{root_inode: {}})
+	db, err := bolt.Open(storage + "/fs.bolt", 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	err = db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte("misc")).Put(schema_key, uint64_b(schema))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return storage
+}
+
+func testSchemaOf(t *testing.T, path string) uint64 {
+	db, err := bolt.Open(path, 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var schema uint64
+	db.View(func(tx *bolt.Tx) error {
+		schema = db_schema(tx)
+		return nil
+	})
+	return schema
+}
+
+func TestMigrateOrder(t *testing.T) {
+	saved, savedVersion := migrations, schema_version
+	defer func() { migrations, schema_version = saved, savedVersion }()
+
+	var order []string
+	migrations = nil
+	for _, name := range []string{"one", "two", "three", "four"} {
+		name := name
+		migrations = append(migrations, migration{name, func(tx *bolt.Tx) error {
+			order = append(order, name)
+			_, err := tx.CreateBucketIfNotExists([]byte("misc"))
+			return err
+		}})
+	}
+	schema_version = uint64(len(migrations))
+
+	db, err := bolt.Open(t.TempDir() + "/fs.bolt", 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for _, c := range []struct {
+		from uint64
+		want []string
+	}{
+		{0, []string{"one", "two", "three", "four"}},
+		{2, []string{"three", "four"}},
+		{4, []string{}},
+	} {
+		order = []string{}
+		var ran []string
+		err = db.Update(func(tx *bolt.Tx) error {
+			b, err := tx.CreateBucketIfNotExists([]byte("misc"))
+			if err != nil {
+				return err
+			}
+			if c.from == 0 {
+				err = b.Delete(schema_key)
+			} else {
+				err = b.Put(schema_key, uint64_b(c.from))
+			}
+			if err != nil {
+				return err
+			}
+			ran, err = migrate(tx)
+			if err != nil {
+				return err
+			}
+			if db_schema(tx) != schema_version {
+				t.Errorf("from %d: schema %d after migrating", c.from, db_schema(tx))
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(order, c.want) || !reflect.DeepEqual(ran, c.want) {
+			t.Errorf("from %d: ran %v, said %v, want %v", c.from, order, ran, c.want)
+		}
+	}
+}
+
+func TestUpgradeBackup(t *testing.T) {
+	storage := testSchemaDB(t, 2)
+	f, err := newfs(storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.CloseBolt()
+
+	bak := storage + "/fs.bolt.schema-2.bak"
+	if got := testSchemaOf(t, bak); got != 2 {
+		t.Errorf("backup has schema %d, want 2", got)
+	}
+	if got := testSchemaOf(t, storage + "/fs.bolt"); got != schema_version {
+		t.Errorf("database has schema %d, want %d", got, schema_version)
+	}
+
+	// up to date, nothing to back up
+	os.Remove(bak)
+	f, err = newfs(storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.CloseBolt()
+	if exists(bak) {
+		t.Error("backed up a database that was up to date")
+	}
+}
+
+func TestUpgradeRefusesNewer(t *testing.T) {
+	storage := testSchemaDB(t, schema_version + 1)
+	if f, err := newfs(storage); err == nil {
+		f.CloseBolt()
+		t.Fatal("opened a database newer than this build")
+	}
+	if _, _, err := MigrateDryRun(storage); err == nil {
+		t.Error("dry run took a database newer than this build")
+	}
+	if got := testSchemaOf(t, storage + "/fs.bolt"); got != schema_version + 1 {
+		t.Errorf("refused database has schema %d now", got)
+	}
+}
+
+func TestMigrateDryRun(t *testing.T) {
+	storage := testSchemaDB(t, 2)
+	from, ran, err := MigrateDryRun(storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{}
+	for _, m := range migrations[2:] {
+		want = append(want, m.name)
+	}
+	if from != 2 || !reflect.DeepEqual(ran, want) {
+		t.Errorf("dry run from %d would run %v, want 2 and %v", from, ran, want)
+	}
+	if got := testSchemaOf(t, storage + "/fs.bolt"); got != 2 {
+		t.Errorf("dry run left schema %d", got)
+	}
+
+	// mounted
+	f, err := newfs(storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.CloseBolt()
+	if _, _, err := MigrateDryRun(storage); err == nil {
+		t.Error("dry run opened a database in use")
+	}
+}
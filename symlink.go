@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"errors"
+	"github.com/boltdb/bolt"
+	"os"
+)
+
+/* SYMLINKS
+
+"symlinks": inode -> target
+	an inode with an entry here is a symlink.  the target is whatever
+	the caller gave, never resolved or checked.
+
+created with Dir.Symlink and logged as TX_SYMLINK.
+*/
+
+type Symlink struct {
+	inode uint64
+	fs *FS
+}
+
+// target of inode, nil if it is not a symlink
+func symlink_target(tx *bolt.Tx, inode uint64) ([]byte, error) {
+	b := tx.Bucket([]byte("symlinks"))
+	if b == nil {
+		return nil, errors.New("Missing symlinks bucket")
+	}
+	v := b.Get(uint64_b(inode))
+	if v == nil {
+		return nil, nil
+	}
+	return append([]byte{}, v...), nil
+}
+
+func (s Symlink) Attr() fuse.Attr {
+	attr := fuse.Attr{
+		Inode: s.inode,
+		Mode: os.ModeSymlink | 0777,
+		Nlink: 1,
+	}
+	s.fs.db.View(func(tx *bolt.Tx) error {
+		target, err := symlink_target(tx, s.inode)
+		if err != nil {
+			return err
+		}
+		attr.Size = uint64(len(target))
+		a, err := load_attr(tx, s.inode)
+		if err != nil {
+			return err
+		}
+		a.fill(&attr)
+		n, err := s.fs.Nlink(tx, s.inode)
+		attr.Nlink = uint32(n)
+		return err
+	})
+	return attr
+}
+
+// chown -h and touch -h.  there is no lchmod, and a size is EINVAL.
+func (s Symlink) Setattr(req *fuse.SetattrRequest, resp *fuse.SetattrResponse, intr fs.Intr) fuse.Error {
+	err := s.fs.Setattr(s.inode, req)
+	if err != nil {
+		return err
+	}
+	resp.Attr = s.Attr()
+	return nil
+}
+
+func (s Symlink) Readlink(req *fuse.ReadlinkRequest, intr fs.Intr) (string, fuse.Error) {
+	var target []byte
+	err := s.fs.db.View(func(tx *bolt.Tx) error {
+		var err error
+		target, err = symlink_target(tx, s.inode)
+		if err == nil && target == nil {
+			err = fuse.ENOENT
+		}
+		return err
+	})
+	return string(target), err
+}
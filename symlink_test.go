@@ -0,0 +1,66 @@
+package main
+
+import (
+	"syscall"
+	"testing"
+
+	"bazil.org/fuse"
+)
+
+func testReadlink(t *testing.T, d Dir, name string) string {
+	n, err := d.Lookup(name, nil)
+	if err != nil {
+		t.Fatalf("lookup %s: %v", name, err)
+	}
+	s, ok := n.(Symlink)
+	if !ok {
+		t.Fatalf("%s is a %T", name, n)
+	}
+	target, err := s.Readlink(&fuse.ReadlinkRequest{}, nil)
+	if err != nil {
+		t.Fatalf("readlink %s: %v", name, err)
+	}
+	return target
+}
+
+func TestSymlink(t *testing.T) {
+	a := testFS(t, 1)
+	b := testFS(t, 2)
+	root := Dir{inode: root_inode, fs: a}
+	n, err := root.Symlink(&fuse.SymlinkRequest{NewName: "l", Target: "../not/there"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if at := n.Attr(); at.Mode & 0777 != 0777 || at.Size != 12 || at.Nlink != 1 {
+		t.Errorf("symlink has mode %v, size %d, nlink %d", at.Mode, at.Size, at.Nlink)
+	}
+	if got := testReadlink(t, root, "l"); got != "../not/there" {
+		t.Errorf("l points at %q", got)
+	}
+	if _, err := root.Symlink(&fuse.SymlinkRequest{NewName: "l", Target: "x"}, nil); err != fuse.Errno(syscall.EEXIST) {
+		t.Errorf("symlink over l: %v", err)
+	}
+	err = n.(Symlink).Setattr(&fuse.SetattrRequest{Valid: fuse.SetattrSize, Size: 1}, &fuse.SetattrResponse{}, nil)
+	if err != fuse.Errno(syscall.EINVAL) {
+		t.Errorf("truncating a symlink: %v", err)
+	}
+	list, err := root.ReadDir(nil)
+	if err != nil || len(list) != 1 || list[0].Type != fuse.DT_Link {
+		t.Errorf("readdir %+v, %v", list, err)
+	}
+
+	testSync(t, a, b)
+	rb := Dir{inode: root_inode, fs: b}
+	if got := testReadlink(t, rb, "l"); got != "../not/there" {
+		t.Errorf("b: l points at %q", got)
+	}
+
+	// a second name for the link itself
+	testLink(t, root, "l2", n)
+	testUnlink(t, root, "l")
+	testSync(t, a, b)
+	checkNames(t, "b", rb, "l2")
+	if got := testReadlink(t, rb, "l2"); got != "../not/there" {
+		t.Errorf("b: l2 points at %q", got)
+	}
+}
@@ -17,8 +17,87 @@ const ( // dont reorder these.  storage format.
 	TX_MKDIR TxOp = iota
 	TX_REMOVE
 	TX_RENAME
+	TX_CREATE
+	TX_SETCONTENT
+	TX_SETXATTR
+	TX_RMXATTR
+	TX_SETATTR
+	TX_LINK
+	TX_SYMLINK
+
+	tx_op_count // keep last
 )
 
+// TX_SETATTR valid bits
+const (
+	tx_attr_mode uint32 = 1 << iota
+	tx_attr_uid
+	tx_attr_gid
+	tx_attr_size
+	tx_attr_atime
+	tx_attr_mtime
+)
+
+// TX_SETATTR payload, carried in Name.  see OPS
+type TxAttr struct {
+	Valid uint32
+	Mode uint32
+	Uid uint32
+	Gid uint32
+	Atime int64
+	Mtime int64
+}
+
+const tx_attr_len = 4*4 + 8*2
+
+/* FORMAT
+
+version 7 (current)
+
+bolt key:   Dbid (u16 BE) Txid (u64 BE)
+	big endian so a cursor walks each database's log in txid order.
+bolt value: Version Unix Body
+wire:       Version Unix Dbid Txid Body
+
+Body:       Op Inode len(Name) Name Inode2 len(Name2) Name2 Oid
+
+everything but the bolt key is little endian.  lengths are TxNameLen.
+
+version 6
+
+as version 7, without TX_SYMLINK.
+
+version 5
+
+as version 6, without TX_LINK.
+
+version 4
+
+as version 5, without Oid in the body.  decodes with Oid 0.
+
+version 3
+
+as version 4, but Inode and Inode2 are the sender's inodes, not oids.
+those read as its oids anyway, see OIDS.
+
+version 2
+
+as version 3, without TX_CREATE, TX_SETCONTENT, TX_SETXATTR,
+TX_RMXATTR and TX_SETATTR.
+
+version 1 (read only)
+
+bolt key:   Version Unix Dbid Txid
+bolt value: Op Inode len(Name) Inode2 len(Name2)
+	the name bytes were never written, so v1 records decode with empty names.
+	v1 was never sent over the wire.
+
+*/
+
+const tx_version uint16 = 7
+const tx_min_version uint16 = 2
+const tx_v1_keylen = 2 + 8 + 2 + 8
+
 type Tx struct {
 	Version uint16
 
@@ -32,86 +111,241 @@ type Tx struct {
 	Name []byte
 	Inode2 uint64
 	Name2 []byte
+
+	// oid of the object acted on, so replay can find it even when it is
+	// known by another name locally.  0 before version 5.
+	Oid uint64
 }
 
+func tx_version_ok(v uint16) bool {
+	return v >= tx_min_version && v <= tx_version
+}
 
-// serialize to bolt storage
-func (txn *Tx) ToKV() ([]byte, []byte, error) {
-	kbody := bytes.Buffer{}
-	body := bytes.Buffer{}
+// whether transactions of version v can carry op
+func tx_op_ok(v uint16, op TxOp) bool {
+	switch op {
+	case TX_CREATE, TX_SETCONTENT, TX_SETXATTR, TX_RMXATTR, TX_SETATTR:
+		return v >= 3
+	case TX_LINK:
+		return v >= 6
+	case TX_SYMLINK:
+		return v >= 7
+	}
+	return op < tx_op_count
+}
+
+// bolt key for a transaction
+func tx_key(dbid uint16, txid uint64) []byte {
+	k := make([]byte, 10)
+	binary.BigEndian.PutUint16(k[0:2], dbid)
+	binary.BigEndian.PutUint64(k[2:10], txid)
+	return k
+}
+
+func (a *TxAttr) Bytes() []byte {
+	buf := bytes.Buffer{}
+	binary.Write(&buf, binary.LittleEndian, a)
+	return buf.Bytes()
+}
+
+func TxAttrFromBytes(b []byte) (*TxAttr, error) {
+	if len(b) != tx_attr_len {
+		return nil, errors.New("Bad attribute record length")
+	}
+	a := TxAttr{}
+	err := binary.Read(bytes.NewReader(b), binary.LittleEndian, &a)
+	if err != nil {
+		return nil, err
+	}
+	return &a, nil
+}
+
+// whether Inode2 names an object, rather than carrying a size
+func tx_inode2_is_ref(op TxOp) bool {
+	switch op {
+	case TX_MKDIR, TX_RENAME, TX_CREATE, TX_LINK, TX_SYMLINK:
+		return true
+	}
+	return false
+}
+
+// Name2 carries xattr values for TX_SETXATTR, names everywhere else
+func tx_name2_max(op TxOp) int {
+	if op == TX_SETXATTR {
+		return max_xattr_len
+	}
+	return max_name_len
+}
+
+func tx_check_lens(op TxOp, name, name2 []byte) error {
+	if len(name) > max_name_len {
+		return syscall.ENAMETOOLONG
+	}
+	if len(name2) > tx_name2_max(op) {
+		if op == TX_SETXATTR {
+			return syscall.E2BIG
+		}
+		return syscall.ENAMETOOLONG
+	}
+	return nil
+}
+
+func (txn *Tx) writeBody(p io.Writer) error {
+	if !tx_op_ok(txn.Version, txn.Op) {
+		return errors.New("Unknown transaction op")
+	}
+	if err := tx_check_lens(txn.Op, txn.Name, txn.Name2); err != nil {
+		return err
+	}
 
 	var err error
 
 	l1 := TxNameLen(len(txn.Name))
 	l2 := TxNameLen(len(txn.Name2))
 
-	err = binary.Write(&kbody, binary.LittleEndian, txn.Version)          ; if(err != nil) { return nil, nil, err }
-	err = binary.Write(&kbody, binary.LittleEndian, txn.Unix)             ; if(err != nil) { return nil, nil, err }
-	err = binary.Write(&kbody, binary.LittleEndian, txn.Dbid)             ; if(err != nil) { return nil, nil, err }
-	err = binary.Write(&kbody, binary.LittleEndian, txn.Txid)             ; if(err != nil) { return nil, nil, err }
+	err = binary.Write(p, binary.LittleEndian, txn.Op)                 ; if(err != nil) { return err }
+	err = binary.Write(p, binary.LittleEndian, txn.Inode)              ; if(err != nil) { return err }
+	err = binary.Write(p, binary.LittleEndian, l1)                     ; if(err != nil) { return err }
+	_, err = p.Write(txn.Name)                                         ; if(err != nil) { return err }
+	err = binary.Write(p, binary.LittleEndian, txn.Inode2)             ; if(err != nil) { return err }
+	err = binary.Write(p, binary.LittleEndian, l2)                     ; if(err != nil) { return err }
+	_, err = p.Write(txn.Name2)                                        ; if(err != nil) { return err }
+	if txn.Version >= 5 {
+		err = binary.Write(p, binary.LittleEndian, txn.Oid)            ; if(err != nil) { return err }
+	}
+
+	return nil
+}
+
+func tx_read_name(p io.Reader, max int) ([]byte, error) {
+	var l TxNameLen
+	err := binary.Read(p, binary.LittleEndian, &l) ; if(err != nil) { return nil, err }
+	if int(l) > max {
+		return nil, errors.New("Transaction name too long")
+	}
+	if l == 0 {
+		return nil, nil
+	}
+	name := make([]byte, l)
+	_, err = io.ReadFull(p, name)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return nil, err
+	}
+	return name, nil
+}
+
+func (txn *Tx) readBody(p io.Reader) error {
+	var err error
 
-	err = binary.Write(&body, binary.LittleEndian, txn.Op)                 ; if(err != nil) { return nil, nil, err }
-	err = binary.Write(&body, binary.LittleEndian, txn.Inode)              ; if(err != nil) { return nil, nil, err }
-	err = binary.Write(&body, binary.LittleEndian, l1)                     ; if(err != nil) { return nil, nil, err }
-	err = binary.Write(&body, binary.LittleEndian, txn.Inode2)             ; if(err != nil) { return nil, nil, err }
-	err = binary.Write(&body, binary.LittleEndian, l2)                     ; if(err != nil) { return nil, nil, err }
+	err = binary.Read(p, binary.LittleEndian, &txn.Op) ; if(err != nil) { return err }
+	if !tx_op_ok(txn.Version, txn.Op) {
+		return errors.New("Unknown transaction op")
+	}
+	err = binary.Read(p, binary.LittleEndian, &txn.Inode) ; if(err != nil) { return err }
+	txn.Name, err = tx_read_name(p, max_name_len) ; if(err != nil) { return err }
+	err = binary.Read(p, binary.LittleEndian, &txn.Inode2) ; if(err != nil) { return err }
+	txn.Name2, err = tx_read_name(p, tx_name2_max(txn.Op)) ; if(err != nil) { return err }
+	if txn.Version >= 5 {
+		err = binary.Read(p, binary.LittleEndian, &txn.Oid) ; if(err != nil) { return err }
+	}
 
-	return kbody.Bytes(), body.Bytes(), nil
+	return nil
+}
+
+// serialize to bolt storage
+func (txn *Tx) ToKV() ([]byte, []byte, error) {
+	if !tx_version_ok(txn.Version) {
+		return nil, nil, errors.New("Unsupported transaction version")
+	}
+
+	body := bytes.Buffer{}
+
+	var err error
+
+	err = binary.Write(&body, binary.LittleEndian, txn.Version)          ; if(err != nil) { return nil, nil, err }
+	err = binary.Write(&body, binary.LittleEndian, txn.Unix)             ; if(err != nil) { return nil, nil, err }
+	err = txn.writeBody(&body)                                           ; if(err != nil) { return nil, nil, err }
+
+	return tx_key(txn.Dbid, txn.Txid), body.Bytes(), nil
 }
 
 // deserialize from bolt storage
 func TxFromKV(k, v []byte) (*Tx, error) {
-	kbody := bytes.NewBuffer(k)
-	body := bytes.NewBuffer(v)
+	if len(k) == tx_v1_keylen && binary.LittleEndian.Uint16(k) == 1 {
+		return txFromKVv1(k, v)
+	}
+	if len(k) != 10 {
+		return nil, errors.New("Bad transaction key")
+	}
 
-	txn := Tx{}
+	body := bytes.NewReader(v)
+
+	txn := Tx{
+		Dbid: binary.BigEndian.Uint16(k[0:2]),
+		Txid: binary.BigEndian.Uint64(k[2:10]),
+	}
 
 	var err error
 
-	err = binary.Read(kbody, binary.LittleEndian, &txn.Version) ; if(err != nil) { return nil, err}
-	if txn.Version != 1 {
+	err = binary.Read(body, binary.LittleEndian, &txn.Version) ; if(err != nil) { return nil, err}
+	if !tx_version_ok(txn.Version) {
 		return nil, errors.New("Unsupported transaction version")
 	}
+	err = binary.Read(body, binary.LittleEndian, &txn.Unix) ; if(err != nil) { return nil, err}
+	err = txn.readBody(body) ; if(err != nil) { return nil, err}
+	if body.Len() != 0 {
+		return nil, errors.New("Trailing bytes in transaction")
+	}
+
+	return &txn, nil
+}
+
+// version 1 records, see FORMAT
+func txFromKVv1(k, v []byte) (*Tx, error) {
+	kbody := bytes.NewReader(k)
+	body := bytes.NewReader(v)
+
+	txn := Tx{}
+
+	var err error
+	var l TxNameLen
+
+	err = binary.Read(kbody, binary.LittleEndian, &txn.Version) ; if(err != nil) { return nil, err}
 	err = binary.Read(kbody, binary.LittleEndian, &txn.Unix) ; if(err != nil) { return nil, err}
 	err = binary.Read(kbody, binary.LittleEndian, &txn.Dbid) ; if(err != nil) { return nil, err}
 	err = binary.Read(kbody, binary.LittleEndian, &txn.Txid) ; if(err != nil) { return nil, err}
 
 	err = binary.Read(body, binary.LittleEndian, &txn.Op) ; if(err != nil) { return nil, err}
 	err = binary.Read(body, binary.LittleEndian, &txn.Inode) ; if(err != nil) { return nil, err}
-	var l TxNameLen
 	err = binary.Read(body, binary.LittleEndian, &l) ; if(err != nil) { return nil, err}
-	if l > 0 {
-		txn.Name = make([]byte, l)
-		err = binary.Read(body, binary.LittleEndian, &txn.Name) ; if(err != nil) { return nil, err}
-	}
 	err = binary.Read(body, binary.LittleEndian, &txn.Inode2) ; if(err != nil) { return nil, err}
 	err = binary.Read(body, binary.LittleEndian, &l) ; if(err != nil) { return nil, err}
-	if l > 0 {
-		txn.Name2 = make([]byte, l)
-		err = binary.Read(body, binary.LittleEndian, &txn.Name2) ; if(err != nil) { return nil, err}
-	}
+
 	return &txn, nil
 }
 
 // serialize to a socket
-func (txn *Tx) WriteTo(p io.Writer) error {
-	var err error
+func (txn *Tx) WriteTo(p io.Writer) (int64, error) {
+	if !tx_version_ok(txn.Version) {
+		return 0, errors.New("Unsupported transaction version")
+	}
 
-	err = binary.Write(p, binary.LittleEndian, txn.Version)           ; if(err != nil) { return err }
-	err = binary.Write(p, binary.LittleEndian, txn.Unix)              ; if(err != nil) { return err }
-	err = binary.Write(p, binary.LittleEndian, txn.Dbid)              ; if(err != nil) { return err }
-	err = binary.Write(p, binary.LittleEndian, txn.Txid)              ; if(err != nil) { return err }
+	buf := bytes.Buffer{}
 
-	l1 := TxNameLen(len(txn.Name))
-	l2 := TxNameLen(len(txn.Name2))
+	var err error
 
-	err = binary.Write(p, binary.LittleEndian, txn.Op)                 ; if(err != nil) { return err }
-	err = binary.Write(p, binary.LittleEndian, txn.Inode)              ; if(err != nil) { return err }
-	err = binary.Write(p, binary.LittleEndian, l1)                     ; if(err != nil) { return err }
-	err = binary.Write(p, binary.LittleEndian, txn.Inode2)             ; if(err != nil) { return err }
-	err = binary.Write(p, binary.LittleEndian, l2)                     ; if(err != nil) { return err }
+	err = binary.Write(&buf, binary.LittleEndian, txn.Version)           ; if(err != nil) { return 0, err }
+	err = binary.Write(&buf, binary.LittleEndian, txn.Unix)              ; if(err != nil) { return 0, err }
+	err = binary.Write(&buf, binary.LittleEndian, txn.Dbid)              ; if(err != nil) { return 0, err }
+	err = binary.Write(&buf, binary.LittleEndian, txn.Txid)              ; if(err != nil) { return 0, err }
+	err = txn.writeBody(&buf)                                            ; if(err != nil) { return 0, err }
 
-	return nil
+	// encode fully first so an encoding error never leaves half a
+	// transaction on the socket
+	return buf.WriteTo(p)
 }
 
 // deserialize from a socket
@@ -121,34 +355,20 @@ func TxReadFrom(p io.Reader) (*Tx, error) {
 	txn := Tx{}
 
 	err = binary.Read(p, binary.LittleEndian, &txn.Version) ; if err != nil { return nil, err }
-	if txn.Version != 1 {
+	if !tx_version_ok(txn.Version) {
 		return nil, errors.New("Unsupported transaction version")
 	}
 	err = binary.Read(p, binary.LittleEndian, &txn.Unix) ; if err != nil { return nil, err }
 	err = binary.Read(p, binary.LittleEndian, &txn.Dbid) ; if err != nil { return nil, err }
 	err = binary.Read(p, binary.LittleEndian, &txn.Txid) ; if err != nil { return nil, err }
+	err = txn.readBody(p) ; if err != nil { return nil, err }
 
-	var l TxNameLen
-
-	err = binary.Read(p, binary.LittleEndian, &txn.Op) ; if err != nil { return nil, err }
-	err = binary.Read(p, binary.LittleEndian, &txn.Inode) ; if err != nil { return nil, err }
-	err = binary.Read(p, binary.LittleEndian, &l) ; if(err != nil) { return nil, err }
-	if l > 0 {
-		txn.Name = make([]byte, l)
-		err = binary.Read(p, binary.LittleEndian, &txn.Name) ; if(err != nil) { return nil, err}
-	}
-	err = binary.Read(p, binary.LittleEndian, &txn.Inode2) ; if(err != nil) { return nil, err}
-	err = binary.Read(p, binary.LittleEndian, &l) ; if(err != nil) { return nil, err}
-	if l > 0 {
-		txn.Name2 = make([]byte, l)
-		err = binary.Read(p, binary.LittleEndian, &txn.Name2) ; if(err != nil) { return nil, err}
-	}
 	return &txn, nil
 }
 
-func (f *FS) NewTx(tx *bolt.Tx, op TxOp, Inode uint64, Name []byte, Inode2 uint64, Name2 []byte) (*Tx, error) {
-	if len(Name) > max_name_len || len(Name2) > max_name_len {
-		return nil, syscall.ENAMETOOLONG
+func (f *FS) NewTx(tx *bolt.Tx, op TxOp, Inode uint64, Name []byte, Inode2 uint64, Name2 []byte, Obj uint64) (*Tx, error) {
+	if err := tx_check_lens(op, Name, Name2); err != nil {
+		return nil, err
 	}
 
 	ts := time.Now().Unix()
@@ -156,13 +376,31 @@ func (f *FS) NewTx(tx *bolt.Tx, op TxOp, Inode uint64, Name []byte, Inode2 uint6
 		return nil, errors.New("Are you in the past?")
 	}
 
+	// the log names objects by oid, not by our inode numbers
+	Inode, err := f.Oid(tx, Inode)
+	if err != nil {
+		return nil, err
+	}
+	if tx_inode2_is_ref(op) {
+		Inode2, err = f.Oid(tx, Inode2)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if Obj != 0 {
+		Obj, err = f.Oid(tx, Obj)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	id, err := f.NewTxId(tx)
 	if err != nil {
 		return nil, err
 	}
 
 	txn := Tx{
-		Version: 1,
+		Version: tx_version,
 
 		Unix: uint64(ts),
 		Dbid: f.dbid,
@@ -173,15 +411,42 @@ func (f *FS) NewTx(tx *bolt.Tx, op TxOp, Inode uint64, Name []byte, Inode2 uint6
 		Name: Name,
 		Inode2: Inode2,
 		Name2: Name2,
+		Oid: Obj,
 	}
 
+	// every transaction we hand out is already in the log, so the caller's
+	// bolt commit covers both the change and its record.
+	err = txn.Save(tx)
+	if err != nil {
+		return nil, err
+	}
+	tx.OnCommit(f.TxNotify)
+
 	return &txn, nil
 }
 
+// append to the "tx" bucket, inside the caller's bolt transaction
+func (txn *Tx) Save(tx *bolt.Tx) error {
+	b := tx.Bucket([]byte("tx"))
+	if b == nil {
+		return errors.New("Missing tx bucket")
+	}
+	k, v, err := txn.ToKV()
+	if err != nil {
+		return err
+	}
+	return b.Put(k, v)
+}
+
 
 
 /* OPS
 
+Inode and Inode2 are oids when they name an object, see OIDS.
+Oid is always the object the transaction acts on: the new one for
+TX_MKDIR, TX_CREATE and TX_SYMLINK, the moved or removed one for TX_RENAME and
+TX_REMOVE, the linked one for TX_LINK, and Inode for the rest.
+
 TX_MKDIR
 Inode: parent dir
 Name: name of new folder
@@ -190,6 +455,10 @@ Inode2: new folder inode
 TX_REMOVE
 Inode: parent dir
 Name: path to remove
+Name2: the remover's high-water marks when it removed, see ZOMBIES:
+	count (u16), then count * { dbid (u16), txid (u64) }, little endian.
+	at most (max_name_len - 2) / 10 of them.  empty from before removes
+	carried marks, which counts as having seen everything.
 
 TX_RENAME
 Inode: parent dir
@@ -197,6 +466,45 @@ Name: filename to move from
 Inode2: new parent dir
 Name2: filename to move to
 
+TX_CREATE
+Inode: parent dir
+Name: name of new file
+Inode2: new file inode
+
+TX_SETCONTENT
+Inode: file
+Inode2: new size
+Name: content reference of the new content, see CHUNKS.  a bare sha256
+	before chunking, empty before the blob store
+
+TX_SETXATTR
+Inode: file or dir
+Name: attribute name
+Name2: attribute value (up to max_xattr_len)
+
+TX_RMXATTR
+Inode: file or dir
+Name: attribute name
+
+TX_SETATTR
+Inode: file, dir or symlink
+Inode2: new size, if tx_attr_size is valid
+Name: TxAttr, little endian: Valid Mode Uid Gid Atime Mtime.
+	only the fields flagged in Valid apply.  times are unix nanoseconds.
+	Mode is an os.FileMode.  we never set tx_attr_size: truncating is a
+	TX_SETCONTENT, see ATTRIBUTES.
+
+TX_LINK
+Inode: parent dir
+Name: name of the new link
+Inode2: file it links to, see LINKS
+
+TX_SYMLINK
+Inode: parent dir
+Name: name of new symlink
+Inode2: new symlink inode
+Name2: where it points
+
 */
 
 
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"testing"
+)
+
+// one transaction of every op, with the kind of names it carries
+func txSamples() []Tx {
+	attr := TxAttr{Valid: tx_attr_mode | tx_attr_mtime, Mode: 0640, Mtime: 1400000000000000000}
+	return []Tx{
+		{Op: TX_MKDIR, Inode: 1, Name: []byte("dir"), Inode2: 0x10002},
+		{Op: TX_REMOVE, Inode: 1, Name: []byte("gone")},
+		{Op: TX_RENAME, Inode: 1, Name: []byte("from"), Inode2: 0x10003, Name2: []byte("to")},
+		{Op: TX_CREATE, Inode: 0x10002, Name: []byte("file"), Inode2: 0x10004},
+		{Op: TX_SETCONTENT, Inode: 0x10004, Name: bytes.Repeat([]byte{0xab}, 64), Inode2: 12345},
+		{Op: TX_SETCONTENT, Inode: 0x10004},
+		{Op: TX_SETXATTR, Inode: 0x10004, Name: []byte("user.big"), Name2: bytes.Repeat([]byte("v"), max_xattr_len)},
+		{Op: TX_RMXATTR, Inode: 0x10004, Name: []byte("user.big")},
+		{Op: TX_SETATTR, Inode: 0x10004, Name: attr.Bytes()},
+		{Op: TX_LINK, Inode: 1, Name: []byte("again"), Inode2: 0x10004},
+		{Op: TX_SYMLINK, Inode: 1, Name: []byte("sym"), Inode2: 0x10005, Name2: []byte("../target")},
+		{Op: TX_MKDIR, Inode: 1, Name: bytes.Repeat([]byte("n"), max_name_len), Inode2: 0x10006},
+	}
+}
+
+func TestTxRoundTrip(t *testing.T) {
+	for v := tx_min_version; v <= tx_version; v++ {
+		for i, txn := range txSamples() {
+			if !tx_op_ok(v, txn.Op) {
+				continue
+			}
+			txn.Version = v
+			txn.Unix = 1400000000 + uint64(i)
+			txn.Dbid = 0x0102
+			txn.Txid = 0x0a0b0c0d + uint64(i)
+			if v >= 5 {
+				txn.Oid = 0x20000 + uint64(i)
+			}
+
+			k, val, err := txn.ToKV()
+			if err != nil {
+				t.Fatalf("v%d op %d: ToKV: %v", v, txn.Op, err)
+			}
+			got, err := TxFromKV(k, val)
+			if err != nil {
+				t.Fatalf("v%d op %d: TxFromKV: %v", v, txn.Op, err)
+			}
+			if !reflect.DeepEqual(*got, txn) {
+				t.Errorf("v%d op %d: bolt form gave %+v, want %+v", v, txn.Op, *got, txn)
+			}
+
+			buf := bytes.Buffer{}
+			n, err := txn.WriteTo(&buf)
+			if err != nil {
+				t.Fatalf("v%d op %d: WriteTo: %v", v, txn.Op, err)
+			}
+			if n != int64(buf.Len()) {
+				t.Errorf("v%d op %d: WriteTo says %d bytes, wrote %d", v, txn.Op, n, buf.Len())
+			}
+			got, err = TxReadFrom(&buf)
+			if err != nil {
+				t.Fatalf("v%d op %d: TxReadFrom: %v", v, txn.Op, err)
+			}
+			if !reflect.DeepEqual(*got, txn) {
+				t.Errorf("v%d op %d: wire form gave %+v, want %+v", v, txn.Op, *got, txn)
+			}
+			if buf.Len() != 0 {
+				t.Errorf("v%d op %d: %d bytes left after TxReadFrom", v, txn.Op, buf.Len())
+			}
+		}
+	}
+}
+
+// versions before 5 have no Oid, so one set on the Tx is not written
+func TestTxOldDropsOid(t *testing.T) {
+	for v := tx_min_version; v < 5; v++ {
+		txn := Tx{Version: v, Dbid: 1, Txid: 1, Op: TX_MKDIR, Inode: 1, Name: []byte("d"), Inode2: 2, Oid: 2}
+		k, val, err := txn.ToKV()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := TxFromKV(k, val)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Oid != 0 {
+			t.Errorf("v%d decoded with Oid %d", v, got.Oid)
+		}
+	}
+}
+
+func txKVv1(txn Tx) ([]byte, []byte) {
+	k := bytes.Buffer{}
+	binary.Write(&k, binary.LittleEndian, uint16(1))
+	binary.Write(&k, binary.LittleEndian, txn.Unix)
+	binary.Write(&k, binary.LittleEndian, txn.Dbid)
+	binary.Write(&k, binary.LittleEndian, txn.Txid)
+	v := bytes.Buffer{}
+	binary.Write(&v, binary.LittleEndian, txn.Op)
+	binary.Write(&v, binary.LittleEndian, txn.Inode)
+	binary.Write(&v, binary.LittleEndian, TxNameLen(len(txn.Name)))
+	binary.Write(&v, binary.LittleEndian, txn.Inode2)
+	binary.Write(&v, binary.LittleEndian, TxNameLen(len(txn.Name2)))
+	return k.Bytes(), v.Bytes()
+}
+
+func TestTxV1ReadOnly(t *testing.T) {
+	for _, txn := range txSamples() {
+		txn.Unix = 1400000000
+		txn.Dbid = 7
+		txn.Txid = 99
+		k, v := txKVv1(txn)
+		got, err := TxFromKV(k, v)
+		if err != nil {
+			t.Fatalf("op %d: %v", txn.Op, err)
+		}
+		want := Tx{Version: 1, Unix: txn.Unix, Dbid: txn.Dbid, Txid: txn.Txid, Op: txn.Op, Inode: txn.Inode, Inode2: txn.Inode2}
+		if !reflect.DeepEqual(*got, want) {
+			t.Errorf("op %d: got %+v, want %+v", txn.Op, *got, want)
+		}
+
+		if _, _, err := got.ToKV(); err == nil {
+			t.Errorf("op %d: v1 encoded to bolt", txn.Op)
+		}
+		if _, err := got.WriteTo(&bytes.Buffer{}); err == nil {
+			t.Errorf("op %d: v1 encoded to wire", txn.Op)
+		}
+	}
+}
+
+func TestTxRejects(t *testing.T) {
+	bad := []Tx{
+		{Version: tx_version, Op: tx_op_count},
+		{Version: tx_version + 1, Op: TX_MKDIR},
+		{Version: tx_version, Op: TX_MKDIR, Name: make([]byte, max_name_len + 1)},
+		{Version: tx_version, Op: TX_RENAME, Name2: make([]byte, max_name_len + 1)},
+	}
+	for _, txn := range bad {
+		if _, _, err := txn.ToKV(); err == nil {
+			t.Errorf("ToKV took %+v", txn)
+		}
+		if _, err := txn.WriteTo(&bytes.Buffer{}); err == nil {
+			t.Errorf("WriteTo took %+v", txn)
+		}
+	}
+
+	// ops newer than the version, on both sides
+	for _, txn := range []Tx{
+		{Version: 2, Dbid: 1, Txid: 1, Op: TX_CREATE, Inode: 1, Name: []byte("f"), Inode2: 2},
+		{Version: 5, Dbid: 1, Txid: 1, Op: TX_LINK, Inode: 1, Name: []byte("again"), Inode2: 2},
+		{Version: 6, Dbid: 1, Txid: 1, Op: TX_SYMLINK, Inode: 1, Name: []byte("sym"), Inode2: 2, Name2: []byte("target")},
+	} {
+		if _, _, err := txn.ToKV(); err == nil {
+			t.Errorf("ToKV took op %d in v%d", txn.Op, txn.Version)
+		}
+		if _, err := txn.WriteTo(&bytes.Buffer{}); err == nil {
+			t.Errorf("WriteTo took op %d in v%d", txn.Op, txn.Version)
+		}
+		ok := txn
+		ok.Version = tx_version
+		k, v, err := ok.ToKV()
+		if err != nil {
+			t.Fatal(err)
+		}
+		binary.LittleEndian.PutUint16(v, txn.Version)
+		if _, err := TxFromKV(k, v); err == nil {
+			t.Errorf("TxFromKV took op %d in v%d", txn.Op, txn.Version)
+		}
+		buf := bytes.Buffer{}
+		ok.WriteTo(&buf)
+		binary.LittleEndian.PutUint16(buf.Bytes(), txn.Version)
+		if _, err := TxReadFrom(&buf); err == nil {
+			t.Errorf("TxReadFrom took op %d in v%d", txn.Op, txn.Version)
+		}
+	}
+
+	txn := txSamples()[2]
+	txn.Version = tx_version
+	k, v, err := txn.ToKV()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := TxFromKV(k, append(v, 0)); err == nil {
+		t.Error("TxFromKV took trailing bytes")
+	}
+	for i := 0; i < len(v); i++ {
+		if _, err := TxFromKV(k, v[:i]); err == nil {
+			t.Errorf("TxFromKV took %d of %d bytes", i, len(v))
+		}
+	}
+	buf := bytes.Buffer{}
+	txn.WriteTo(&buf)
+	wire := buf.Bytes()
+	for i := 0; i < len(wire); i++ {
+		if _, err := TxReadFrom(bytes.NewReader(wire[:i])); err == nil {
+			t.Errorf("TxReadFrom took %d of %d bytes", i, len(wire))
+		}
+	}
+}
+
+func FuzzTxReadFrom(f *testing.F) {
+	for v := tx_min_version; v <= tx_version; v++ {
+		for _, txn := range txSamples() {
+			txn.Version = v
+			buf := bytes.Buffer{}
+			txn.WriteTo(&buf)
+			f.Add(buf.Bytes())
+		}
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		r := bytes.NewReader(data)
+		txn, err := TxReadFrom(r)
+		if err != nil {
+			return
+		}
+		used := data[:len(data) - r.Len()]
+
+		buf := bytes.Buffer{}
+		if _, err := txn.WriteTo(&buf); err != nil {
+			t.Fatalf("decoded %+v but can't encode it: %v", txn, err)
+		}
+		if !bytes.Equal(buf.Bytes(), used) {
+			t.Fatalf("re-encoded %x, read %x", buf.Bytes(), used)
+		}
+		again, err := TxReadFrom(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(again, txn) {
+			t.Fatalf("decoded %+v, then %+v", txn, again)
+		}
+	})
+}
+
+func FuzzTxFromKV(f *testing.F) {
+	for v := tx_min_version; v <= tx_version; v++ {
+		for _, txn := range txSamples() {
+			txn.Version = v
+			k, val, _ := txn.ToKV()
+			f.Add(k, val)
+		}
+	}
+	k, v := txKVv1(txSamples()[2])
+	f.Add(k, v)
+	f.Fuzz(func(t *testing.T, k, v []byte) {
+		txn, err := TxFromKV(k, v)
+		if err != nil || txn.Version == 1 {
+			// v1 is read only
+			return
+		}
+
+		k2, v2, err := txn.ToKV()
+		if err != nil {
+			t.Fatalf("decoded %+v but can't encode it: %v", txn, err)
+		}
+		if !bytes.Equal(k2, k) || !bytes.Equal(v2, v) {
+			t.Fatalf("re-encoded %x %x, read %x %x", k2, v2, k, v)
+		}
+		again, err := TxFromKV(k2, v2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(again, txn) {
+			t.Fatalf("decoded %+v, then %+v", txn, again)
+		}
+	})
+}
@@ -0,0 +1,464 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/boltdb/bolt"
+	"math"
+)
+
+/* ZOMBIES
+
+see CONFLICT RESOLUTION in tx.go.
+
+a TX_REMOVE carries, in Name2, the remover's high-water marks when it
+removed the path: what it had seen from every database.  replaying it, we
+look through our log past what the remover had seen of each database but
+its own.  if any of those transactions touched the object or anything
+under it, the remover could not have known about those changes, and
+instead of removing the path we rename it to "name-ZOMBIE" and flag it
+with the database that made them, us if we were one of them:
+
+"zombies": dir inode -> { zombie name -> dbid (u16) + original name }
+
+a zombie is only visible to the dbid in its flag, the one that modified
+it after the remove.  everyone who had that database's changes keeps a
+copy hidden away; the remover, and anyone else who never saw them, just
+drops the path.
+
+renaming a zombie restores it: the subtree gets fresh oids and is logged
+again as new objects, since the remover has forgotten the old ones.
+removing a zombie removes it for good.  either way the zombie itself is
+logged as removed, under its original name, so the hidden copies go too.
+*/
+
+const zombie_suffix = "-ZOMBIE"
+
+// TX_REMOVE Name2: count (u16), then count * { dbid (u16), txid (u64) }
+func tx_marks_bytes(marks map[uint16]uint64) []byte {
+	max := (max_name_len - 2) / 10
+	buf := bytes.Buffer{}
+	n := len(marks)
+	if n > max {
+		// leaving some out only makes zombies more likely, never less
+		n = max
+	}
+	binary.Write(&buf, binary.LittleEndian, uint16(n))
+	for dbid, txid := range marks {
+		if n == 0 {
+			break
+		}
+		binary.Write(&buf, binary.LittleEndian, dbid)
+		binary.Write(&buf, binary.LittleEndian, txid)
+		n--
+	}
+	return buf.Bytes()
+}
+
+func tx_marks_from_bytes(b []byte) (map[uint16]uint64, error) {
+	r := bytes.NewReader(b)
+	var n uint16
+	err := binary.Read(r, binary.LittleEndian, &n)
+	if err != nil {
+		return nil, err
+	}
+	marks := make(map[uint16]uint64, n)
+	for i := uint16(0); i < n; i++ {
+		var dbid uint16
+		var txid uint64
+		err = binary.Read(r, binary.LittleEndian, &dbid) ; if err != nil { return nil, err }
+		err = binary.Read(r, binary.LittleEndian, &txid) ; if err != nil { return nil, err }
+		marks[dbid] = txid
+	}
+	return marks, nil
+}
+
+func zombie_index(tx *bolt.Tx) (*bolt.Bucket, error) {
+	b := tx.Bucket([]byte("zombies"))
+	if b == nil {
+		return nil, errors.New("Missing zombies bucket")
+	}
+	return b, nil
+}
+
+// zombie flag for entry name in dir: the dbid that sees it, 0 if name is
+// not a zombie
+func (f *FS) ZombieDbid(tx *bolt.Tx, dir uint64, name []byte) (uint16, error) {
+	zb, err := zombie_index(tx)
+	if err != nil {
+		return 0, err
+	}
+	dz := zb.Bucket(uint64_b(dir))
+	if dz == nil {
+		return 0, nil
+	}
+	v := dz.Get(name)
+	if len(v) < 2 {
+		return 0, nil
+	}
+	return b_uint16(v[:2]), nil
+}
+
+// whether entry name in dir should be shown to this database
+func (f *FS) Visible(tx *bolt.Tx, dir uint64, name []byte) (bool, error) {
+	dbid, err := f.ZombieDbid(tx, dir, name)
+	if err != nil {
+		return false, err
+	}
+	return dbid == 0 || dbid == f.dbid, nil
+}
+
+// the original name of a zombie entry in dir, nil if name is not a zombie
+func (f *FS) ZombieOrig(tx *bolt.Tx, dir uint64, name []byte) ([]byte, error) {
+	zb, err := zombie_index(tx)
+	if err != nil {
+		return nil, err
+	}
+	dz := zb.Bucket(uint64_b(dir))
+	if dz == nil {
+		return nil, nil
+	}
+	v := dz.Get(name)
+	if len(v) < 2 {
+		return nil, nil
+	}
+	return append([]byte{}, v[2:]...), nil
+}
+
+// the zombie entry in dir for object obj of dbid, once called name, nil
+// if there is none.  only replayed removes look for zombies, the rest
+// were made by someone who didn't know the object was removed.
+func (f *FS) replayZombie(tx *bolt.Tx, dbid uint16, dir uint64, dkids *bolt.Bucket, name []byte, obj uint64) ([]byte, error) {
+	if obj == 0 {
+		return nil, nil
+	}
+	zb, err := zombie_index(tx)
+	if err != nil {
+		return nil, err
+	}
+	dz := zb.Bucket(uint64_b(dir))
+	if dz == nil {
+		return nil, nil
+	}
+	local, err := f.replayInode(tx, dbid, obj)
+	if err != nil || local == 0 {
+		return nil, err
+	}
+	c := dz.Cursor()
+	for k, v := c.First(); k != nil; k, v = c.Next() {
+		if len(v) >= 2 && bytes.Equal(v[2:], name) && b_uint64(dkids.Get(k)) == local {
+			return append([]byte{}, k...), nil
+		}
+	}
+	return nil, nil
+}
+
+func (f *FS) dropZombie(tx *bolt.Tx, dir uint64, name []byte) error {
+	zb, err := zombie_index(tx)
+	if err != nil {
+		return err
+	}
+	dz := zb.Bucket(uint64_b(dir))
+	if dz == nil {
+		return nil
+	}
+	return dz.Delete(name)
+}
+
+// local inodes of inode and everything under it
+func (f *FS) subtree(tx *bolt.Tx, inode uint64) ([]uint64, error) {
+	kids := tx.Bucket([]byte("kids"))
+	if kids == nil {
+		return nil, errors.New("Missing kids bucket")
+	}
+	list := []uint64{inode}
+	for i := 0; i < len(list); i++ {
+		dkids := kids.Bucket(uint64_b(list[i]))
+		if dkids == nil {
+			continue
+		}
+		dkids.ForEach(func(k, v []byte) error {
+			list = append(list, b_uint64(v))
+			return nil
+		})
+	}
+	return list, nil
+}
+
+// the database that changed inode or anything under it in transactions
+// the remover of txn had not seen, 0 if none did.  us, if we did.
+func (f *FS) modifiedBy(tx *bolt.Tx, txn *Tx, inode uint64) (uint16, error) {
+	if len(txn.Name2) == 0 {
+		// from before removes carried marks, assume they knew
+		return 0, nil
+	}
+	seen, err := tx_marks_from_bytes(txn.Name2)
+	if err != nil {
+		return 0, err
+	}
+
+	list, err := f.subtree(tx, inode)
+	if err != nil {
+		return 0, err
+	}
+	oids := map[uint64]bool{}
+	for _, i := range list {
+		oid, err := f.Oid(tx, i)
+		if err != nil {
+			return 0, err
+		}
+		oids[oid] = true
+	}
+
+	b := tx.Bucket([]byte("tx"))
+	if b == nil {
+		return 0, errors.New("Missing tx bucket")
+	}
+	c := b.Cursor()
+	touched := func(dbid uint16) (bool, error) {
+		if dbid == txn.Dbid || seen[dbid] == math.MaxUint64 {
+			return false, nil
+		}
+		for k, v := c.Seek(tx_key(dbid, seen[dbid] + 1)); k != nil; k, v = c.Next() {
+			if len(k) != 10 || binary.BigEndian.Uint16(k) != dbid {
+				break
+			}
+			later, err := TxFromKV(k, v)
+			if err != nil {
+				return false, err
+			}
+			if oids[later.Oid] || oids[later.Inode] || (tx_inode2_is_ref(later.Op) && oids[later.Inode2]) {
+				return true, nil
+			}
+		}
+		return false, nil
+	}
+
+	hit, err := touched(f.dbid)
+	if err != nil {
+		return 0, err
+	}
+	if hit {
+		return f.dbid, nil
+	}
+	marks, err := f.TxMarks(tx)
+	if err != nil {
+		return 0, err
+	}
+	// the lowest, so everyone picks the same one
+	by := uint16(0)
+	for dbid := range marks {
+		if dbid == f.dbid || (by != 0 && dbid > by) {
+			continue
+		}
+		hit, err = touched(dbid)
+		if err != nil {
+			return 0, err
+		}
+		if hit {
+			by = dbid
+		}
+	}
+	return by, nil
+}
+
+// a free name in dkids for a zombie of orig
+func zombie_name(dkids *bolt.Bucket, orig []byte) []byte {
+	base := orig
+	var name []byte
+	for n := 1; ; n++ {
+		suffix := zombie_suffix
+		if n > 1 {
+			suffix = fmt.Sprintf("%s-%d", zombie_suffix, n)
+		}
+		if len(base) + len(suffix) > max_name_len {
+			base = base[:max_name_len - len(suffix)]
+		}
+		name = append(append([]byte{}, base...), suffix...)
+		if dkids.Get(name) == nil {
+			return name
+		}
+	}
+}
+
+// rename entry in dir to a zombie, flagged for dbid.  an entry that
+// already is one just changes hands.
+func (f *FS) zombify(tx *bolt.Tx, dir uint64, dkids *bolt.Bucket, entry []byte, dbid uint16) error {
+	zb, err := zombie_index(tx)
+	if err != nil {
+		return err
+	}
+	dz, err := zb.CreateBucketIfNotExists(uint64_b(dir))
+	if err != nil {
+		return err
+	}
+	orig, err := f.LogName(tx, dir, entry)
+	if err != nil {
+		return err
+	}
+	if dz.Get(entry) != nil {
+		return dz.Put(entry, append(uint16_b(dbid), orig...))
+	}
+
+	name := zombie_name(dkids, orig)
+	val := append([]byte{}, dkids.Get(entry)...)
+	err = kid_delete(tx, dkids, dir, entry)
+	if err != nil {
+		return err
+	}
+	err = f.unlinkedName(tx, dir, dkids, entry)
+	if err != nil {
+		return err
+	}
+	err = kid_put(tx, dkids, dir, name, val)
+	if err != nil {
+		return err
+	}
+	return dz.Put(name, append(uint16_b(dbid), orig...))
+}
+
+// move zombie entry in dir to another zombie name, out of the way of a
+// name this database sees as free.  replay finds zombies by object and
+// original name, so it still does.
+func (f *FS) moveZombie(tx *bolt.Tx, dir uint64, dkids *bolt.Bucket, entry []byte) error {
+	zb, err := zombie_index(tx)
+	if err != nil {
+		return err
+	}
+	dz := zb.Bucket(uint64_b(dir))
+	if dz == nil {
+		return errors.New("Missing directory zombies bucket")
+	}
+	flag := append([]byte{}, dz.Get(entry)...)
+	if len(flag) < 2 {
+		return errors.New("Not a zombie")
+	}
+	name := zombie_name(dkids, flag[2:])
+	val := append([]byte{}, dkids.Get(entry)...)
+	err = kid_delete(tx, dkids, dir, entry)
+	if err != nil {
+		return err
+	}
+	err = kid_put(tx, dkids, dir, name, val)
+	if err != nil {
+		return err
+	}
+	err = dz.Delete(entry)
+	if err != nil {
+		return err
+	}
+	return dz.Put(name, flag)
+}
+
+// give inode a new oid nobody else has heard of
+func (f *FS) rekey(tx *bolt.Tx, inode uint64) error {
+	oidx := tx.Bucket([]byte("oidx"))
+	if oidx == nil {
+		return errors.New("Missing oidx bucket")
+	}
+	old, err := f.Oid(tx, inode)
+	if err != nil {
+		return err
+	}
+	err = oidx.Delete(uint64_b(old))
+	if err != nil {
+		return err
+	}
+	n, err := f.nextInode(tx)
+	if err != nil {
+		return err
+	}
+	return f.setOid(tx, inode, make_oid(f.dbid, n))
+}
+
+// log a restored zombie, now at dir/name, and everything under it as new
+func (f *FS) resurrect(tx *bolt.Tx, dir uint64, name []byte, inode uint64) error {
+	kids := tx.Bucket([]byte("kids"))
+	if kids == nil {
+		return errors.New("Missing kids bucket")
+	}
+	xtb := tx.Bucket([]byte("xattrs"))
+	if xtb == nil {
+		return errors.New("Missing xattrs bucket")
+	}
+
+	err := f.rekey(tx, inode)
+	if err != nil {
+		return err
+	}
+	logname, err := f.LogName(tx, dir, name)
+	if err != nil {
+		return err
+	}
+
+	key := uint64_b(inode)
+	r, err := load_inode(tx, inode)
+	if err != nil {
+		return err
+	}
+	if r == nil {
+		return errors.New("Inode record missing")
+	}
+	switch r.Type {
+	case inode_symlink:
+		var target []byte
+		target, err = symlink_target(tx, inode)
+		if err != nil {
+			return err
+		}
+		_, err = f.NewTx(tx, TX_SYMLINK, dir, logname, inode, target, inode)
+	case inode_file:
+		_, err = f.NewTx(tx, TX_CREATE, dir, logname, inode, nil, inode)
+		if err != nil {
+			return err
+		}
+		var ref []byte
+		ref, err = content_ref(tx, inode)
+		if err != nil {
+			return err
+		}
+		_, err = f.NewTx(tx, TX_SETCONTENT, inode, ref, r.Size, nil, inode)
+	default:
+		_, err = f.NewTx(tx, TX_MKDIR, dir, logname, inode, nil, inode)
+	}
+	if err != nil {
+		return err
+	}
+	err = f.logAttr(tx, inode, &r.Attr)
+	if err != nil {
+		return err
+	}
+
+	if xb := xtb.Bucket(key); xb != nil {
+		err = xb.ForEach(func(k, v []byte) error {
+			_, err := f.NewTx(tx, TX_SETXATTR, inode, k, 0, v, inode)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	dkids := kids.Bucket(key)
+	if dkids == nil {
+		return nil
+	}
+	type kid struct {
+		name []byte
+		inode uint64
+	}
+	list := []kid{}
+	dkids.ForEach(func(k, v []byte) error {
+		list = append(list, kid{append([]byte{}, k...), b_uint64(v)})
+		return nil
+	})
+	for _, k := range list {
+		err = f.resurrect(tx, inode, k.name, k.inode)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
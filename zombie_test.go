@@ -0,0 +1,128 @@
+package main
+
+import (
+	"testing"
+
+	"bazil.org/fuse"
+	"github.com/boltdb/bolt"
+)
+
+// whether dir has an entry name at all, visible or not
+func hasEntry(t *testing.T, f *FS, dir uint64, name string) bool {
+	found := false
+	err := f.db.View(func(tx *bolt.Tx) error {
+		dkids := tx.Bucket([]byte("kids")).Bucket(uint64_b(dir))
+		found = dkids != nil && dkids.Get([]byte(name)) != nil
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return found
+}
+
+// a removes d while b, not having heard of it yet, makes d/x
+func zombieSetup(t *testing.T) (*FS, *FS) {
+	a := testFS(t, 1)
+	b := testFS(t, 2)
+	ra, rb := Dir{inode: root_inode, fs: a}, Dir{inode: root_inode, fs: b}
+
+	testMkdir(t, ra, "d")
+	testMkdir(t, ra, "keep")
+	testSync(t, a, b)
+
+	testMkdir(t, testLookupDir(t, rb, "d"), "x")
+	testRmdir(t, ra, "d")
+	testSync(t, a, b)
+
+	checkNames(t, "remover", ra, "keep")
+	checkNames(t, "modifier", rb, "d-ZOMBIE", "keep")
+	checkNames(t, "modifier's zombie", testLookupDir(t, rb, "d-ZOMBIE"), "x")
+	return a, b
+}
+
+func TestZombieRestore(t *testing.T) {
+	a, b := zombieSetup(t)
+	ra, rb := Dir{inode: root_inode, fs: a}, Dir{inode: root_inode, fs: b}
+
+	err := rb.Rename(&fuse.RenameRequest{OldName: "d-ZOMBIE", NewName: "d"}, rb, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testSync(t, a, b)
+
+	checkNames(t, "remover", ra, "d", "keep")
+	checkNames(t, "modifier", rb, "d", "keep")
+	checkNames(t, "remover's d", testLookupDir(t, ra, "d"), "x")
+	checkNames(t, "modifier's d", testLookupDir(t, rb, "d"), "x")
+
+	// restored for good: it goes away like anything else
+	testRmdir(t, testLookupDir(t, ra, "d"), "x")
+	testRmdir(t, ra, "d")
+	testSync(t, a, b)
+	checkNames(t, "remover", ra, "keep")
+	checkNames(t, "modifier", rb, "keep")
+}
+
+func TestZombieRemove(t *testing.T) {
+	a, b := zombieSetup(t)
+	ra, rb := Dir{inode: root_inode, fs: a}, Dir{inode: root_inode, fs: b}
+
+	testRmdir(t, testLookupDir(t, rb, "d-ZOMBIE"), "x")
+	testRmdir(t, rb, "d-ZOMBIE")
+	testSync(t, a, b)
+
+	checkNames(t, "remover", ra, "keep")
+	checkNames(t, "modifier", rb, "keep")
+	if hasEntry(t, b, root_inode, "d-ZOMBIE") {
+		t.Error("modifier kept its zombie")
+	}
+}
+
+// a third database that had the modifier's change keeps the zombie out of
+// sight, until the modifier gives it up
+func TestZombieHidden(t *testing.T) {
+	a := testFS(t, 1)
+	b := testFS(t, 2)
+	c := testFS(t, 3)
+	ra := Dir{inode: root_inode, fs: a}
+	rb := Dir{inode: root_inode, fs: b}
+	rc := Dir{inode: root_inode, fs: c}
+
+	testMkdir(t, ra, "d")
+	testSync(t, a, b)
+	testSync(t, a, c)
+
+	testMkdir(t, testLookupDir(t, rb, "d"), "x")
+	testSync(t, b, c)
+	testRmdir(t, ra, "d")
+	testSync(t, a, c)
+
+	checkNames(t, "remover", ra)
+	checkNames(t, "bystander", rc)
+	if !hasEntry(t, c, root_inode, "d-ZOMBIE") {
+		t.Fatal("bystander dropped the modifier's zombie")
+	}
+	if _, err := rc.Lookup("d-ZOMBIE", nil); err != fuse.ENOENT {
+		t.Errorf("bystander looked up the modifier's zombie: %v", err)
+	}
+
+	testSync(t, a, b)
+	checkNames(t, "modifier", rb, "d-ZOMBIE")
+
+	err := rb.Rename(&fuse.RenameRequest{OldName: "d-ZOMBIE", NewName: "back"}, rb, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testSync(t, b, c)
+	testSync(t, a, c)
+
+	for _, f := range []*FS{a, b, c} {
+		r := Dir{inode: root_inode, fs: f}
+		checkNames(t, "everyone", r, "back")
+		checkNames(t, "everyone's back", testLookupDir(t, r, "back"), "x")
+		if hasEntry(t, f, root_inode, "d-ZOMBIE") {
+			t.Errorf("dbid %d kept a zombie", f.dbid)
+		}
+	}
+}